@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestParallelUsesTheCache(t *testing.T) {
+	people := newFakePeople("Sam")
+	s, _ := newTestServer(t, people, func(config *Config) {
+		config.DatabaseCacheTTL = time.Minute
+	})
+	testServer := startTestServer(t, s)
+
+	for i := 0; i < 2; i++ {
+		response, body := do(t, http.MethodGet, testServer.URL+"/parallel", "", nil)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("request %d status = %d, want %d: %s", i, response.StatusCode, http.StatusOK, body)
+		}
+		if warning := response.Header.Get("Warning"); warning != "" {
+			t.Errorf("request %d has the warning %q, want none for a fresh person", i, warning)
+		}
+	}
+	if calls := people.calls.Load(); calls != 1 {
+		t.Errorf("the database was called %d times, want once with the second request finding the person cached", calls)
+	}
+}
+
+func TestParallelServesTheStalePersonWhenTheDatabaseIsDown(t *testing.T) {
+	people := newFakePeople("Sam")
+	s, _ := newTestServer(t, people, func(config *Config) {
+		config.DatabaseCacheTTL = 10 * time.Millisecond
+	})
+	testServer := startTestServer(t, s)
+
+	response, body := do(t, http.MethodGet, testServer.URL+"/parallel", "", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", response.StatusCode, http.StatusOK, body)
+	}
+
+	// the cached person expires and then the database goes down
+	time.Sleep(20 * time.Millisecond)
+	people.fail(errors.New("connection refused"))
+
+	response, body = do(t, http.MethodGet, testServer.URL+"/parallel", "", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", response.StatusCode, http.StatusOK, body)
+	}
+	if warning := response.Header.Get("Warning"); warning != staleWarning {
+		t.Errorf("Warning = %q, want %q", warning, staleWarning)
+	}
+	if !strings.Contains(body, `"Name":"Sam"`) {
+		t.Errorf("body %s doesn't hold the stale person", body)
+	}
+}
+
+func TestParallelFailsWithoutACachedPersonWhenTheDatabaseIsDown(t *testing.T) {
+	for _, ttl := range []time.Duration{0, time.Minute} {
+		t.Run(fmt.Sprintf("ttl %s", ttl), func(t *testing.T) {
+			people := newFakePeople("Sam")
+			people.err = errors.New("connection refused")
+			s, _ := newTestServer(t, people, func(config *Config) {
+				config.DatabaseCacheTTL = ttl
+			})
+			testServer := startTestServer(t, s)
+
+			response, body := do(t, http.MethodGet, testServer.URL+"/parallel", "", nil)
+			if response.StatusCode != http.StatusInternalServerError {
+				t.Errorf("status = %d, want %d: %s", response.StatusCode, http.StatusInternalServerError, body)
+			}
+			if warning := response.Header.Get("Warning"); warning != "" {
+				t.Errorf("Warning = %q, want none", warning)
+			}
+		})
+	}
+}
+
+func TestIsDatabaseUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"database down", context.Background(), errors.New("connection refused"), true},
+		{"query timed out", context.Background(), fmt.Errorf("querying a person: %w", context.DeadlineExceeded), true},
+		{"request cancelled", cancelledContext(), errors.New("connection refused"), false},
+		{"request expired", expiredContext(), errors.New("connection refused"), false},
+		{"empty table", context.Background(), pgx.ErrNoRows, false},
+		{"no headroom", context.Background(), errNoHeadroom, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isDatabaseUnavailable(test.ctx, test.err); got != test.want {
+				t.Errorf("isDatabaseUnavailable() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCachedDatabaseCallMissThenHit(t *testing.T) {
+	people := newFakePeople("Sam")
+	s, _ := newTestServer(t, people, func(config *Config) {
+		config.DatabaseCacheTTL = time.Minute
+	})
+
+	for i := 0; i < 2; i++ {
+		person, stale, err := s.cachedDatabaseCall(context.Background())
+		if err != nil || stale || person.Name != "Sam" {
+			t.Fatalf("call %d = %+v, %v, %v, want Sam", i, person, stale, err)
+		}
+	}
+	if calls := people.calls.Load(); calls != 1 {
+		t.Errorf("the database was called %d times, want once", calls)
+	}
+}
+
+func TestCachedDatabaseCallSharesConcurrentCalls(t *testing.T) {
+	people := newFakePeople("Sam")
+	people.delay = 100 * time.Millisecond
+	s, _ := newTestServer(t, people, func(config *Config) {
+		config.DatabaseCacheTTL = time.Minute
+	})
+
+	const callers = 5
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			person, _, err := s.cachedDatabaseCall(context.Background())
+			if err == nil && person.Name != "Sam" {
+				err = fmt.Errorf("found %+v, want Sam", person)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if calls := people.calls.Load(); calls != 1 {
+		t.Errorf("the database was called %d times, want the callers to share one call", calls)
+	}
+}
+
+func TestCachedDatabaseCallOutlivesTheFirstCaller(t *testing.T) {
+	people := newFakePeople("Sam")
+	people.delay = 100 * time.Millisecond
+	s, _ := newTestServer(t, people, func(config *Config) {
+		config.DatabaseCacheTTL = time.Minute
+	})
+
+	// the first caller starts the shared call and then goes away while it is running
+	firstCtx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, _, err := s.cachedDatabaseCall(firstCtx)
+		first <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	person, stale, err := s.cachedDatabaseCall(context.Background())
+	if err != nil || stale || person.Name != "Sam" {
+		t.Errorf("the second caller got %+v, %v, %v, want Sam", person, stale, err)
+	}
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("the first caller got %v, want %v", err, context.Canceled)
+	}
+	if calls := people.calls.Load(); calls != 1 {
+		t.Errorf("the database was called %d times, want the callers to share one call", calls)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configVariables The environment variables read by LoadConfig.
+var configVariables = []string{
+	"ACCESS_LOG_FORMAT", "ADMIN_KEY", "AGGREGATE_SOURCE_TIMEOUT", "API_KEYS", "DATABASE_ACQUIRE_TIMEOUT",
+	"DATABASE_CACHE_TTL", "DATABASE_MAX_CONNS", "DATABASE_QUERY_TIMEOUT", "DATABASE_STARTUP_TIMEOUT",
+	"DATABASE_STATEMENT_TIMEOUT", "DATABASE_URL", "DEBUG_HTTP", "HTTP_IDLE_TIMEOUT", "HTTP_READ_TIMEOUT",
+	"HTTP_WRITE_TIMEOUT", "LISTEN_ADDR", "LOG_LEVEL", "LOG_SAMPLE_RATE", "MAX_BODY_BYTES", "MAX_CONCURRENT_REQUESTS",
+	"MIN_DEADLINE_HEADROOM", "PAUSE_DURATION", "PRETTY_JSON", "RATE_LIMIT", "RATE_LIMIT_BURST", "REST_CALL_TIMEOUT",
+	"REST_MAX_REDIRECTS", "SERVER_SIDE_BASE_URL", "SHUTDOWN_TIMEOUT", "TLS_CERT_FILE", "TLS_KEY_FILE",
+}
+
+// unsetConfig Empties the variables read by LoadConfig for the rest of the test, so the environment the tests are run
+// in can't change the settings. An empty variable is treated the same as one that isn't set.
+func unsetConfig(t *testing.T) {
+	t.Helper()
+	for _, name := range configVariables {
+		t.Setenv(name, "")
+	}
+}
+
+func TestLoadConfigPauseDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 5 * time.Second, false},
+		{"200ms", 200 * time.Millisecond, false},
+		{"0s", 0, false},
+		{"-1s", 5 * time.Second, true},
+		{"five seconds", 5 * time.Second, true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			t.Setenv("PAUSE_DURATION", test.value)
+			config, err := LoadConfig()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("LoadConfig() error = %v, want error %t", err, test.wantErr)
+			}
+			if config.PauseDuration != test.want {
+				t.Errorf("PauseDuration = %s, want %s", config.PauseDuration, test.want)
+			}
+		})
+	}
+}
+
+func TestNewHTTPServerAppliesTheTimeouts(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		server := newHTTPServer(defaultConfig(), http.NotFoundHandler())
+		if server.Addr != ":8080" || server.ReadTimeout != 10*time.Second || server.WriteTimeout != 20*time.Second ||
+			server.IdleTimeout != 60*time.Second {
+			t.Errorf("server = %s with timeouts %s, %s, %s, want :8080 with 10s, 20s, 60s", server.Addr,
+				server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+		}
+		// the write timeout is the backstop, the request's own budget has to run out first so it can respond
+		if server.WriteTimeout <= defaultRequestTimeout {
+			t.Errorf("write timeout %s isn't longer than the request timeout %s", server.WriteTimeout,
+				defaultRequestTimeout)
+		}
+	})
+	t.Run("from the environment", func(t *testing.T) {
+		t.Setenv("HTTP_READ_TIMEOUT", "1s")
+		t.Setenv("HTTP_WRITE_TIMEOUT", "2s")
+		t.Setenv("HTTP_IDLE_TIMEOUT", "3s")
+		config, err := LoadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := newHTTPServer(config, http.NotFoundHandler())
+		if server.ReadTimeout != time.Second || server.WriteTimeout != 2*time.Second ||
+			server.IdleTimeout != 3*time.Second {
+			t.Errorf("timeouts = %s, %s, %s, want 1s, 2s, 3s", server.ReadTimeout, server.WriteTimeout,
+				server.IdleTimeout)
+		}
+	})
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	unsetConfig(t)
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := defaultConfig(); !reflect.DeepEqual(config, want) {
+		t.Errorf("config = %+v, want the defaults %+v", config, want)
+	}
+}
+
+func TestLoadConfigValid(t *testing.T) {
+	unsetConfig(t)
+	for name, value := range map[string]string{
+		"LISTEN_ADDR":             "127.0.0.1:9090",
+		"SERVER_SIDE_BASE_URL":    "http://localhost:9091/",
+		"DATABASE_URL":            "postgres://user:secret@db:5432/people",
+		"DATABASE_MAX_CONNS":      "4",
+		"REST_CALL_TIMEOUT":       "2s",
+		"RATE_LIMIT":              "2.5",
+		"API_KEYS":                " first, ,second ",
+		"MAX_CONCURRENT_REQUESTS": "0",
+		"LOG_LEVEL":               "warn",
+		"ACCESS_LOG_FORMAT":       "combined",
+		"PRETTY_JSON":             "1",
+	} {
+		t.Setenv(name, value)
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := defaultConfig()
+	want.ListenAddr = "127.0.0.1:9090"
+	// the trailing slash is dropped as the endpoint path is appended to it
+	want.ServerSideBaseURL = "http://localhost:9091"
+	want.DatabaseURL = "postgres://user:secret@db:5432/people"
+	want.DatabaseMaxConns = 4
+	want.RestCallTimeout = 2 * time.Second
+	want.RateLimit = 2.5
+	want.APIKeys = []string{"first", "second"}
+	want.LogLevel = slog.LevelWarn
+	want.CombinedAccessLog = true
+	want.PrettyJSON = true
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("config = %+v, want %+v", config, want)
+	}
+}
+
+func TestLoadConfigMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"HTTP_READ_TIMEOUT", "10"},
+		{"HTTP_READ_TIMEOUT", "0s"},
+		{"DATABASE_QUERY_TIMEOUT", "-3s"},
+		{"LISTEN_ADDR", "8080"},
+		{"LISTEN_ADDR", ":80800"},
+		{"SERVER_SIDE_BASE_URL", "localhost:8080"},
+		{"SERVER_SIDE_BASE_URL", "ftp://localhost"},
+		{"DATABASE_URL", "postgres://localhost:port"},
+		{"DATABASE_MAX_CONNS", "0"},
+		{"RATE_LIMIT", "fast"},
+		{"RATE_LIMIT_BURST", "0"},
+		{"MAX_BODY_BYTES", "1MiB"},
+		{"LOG_LEVEL", "loud"},
+		{"LOG_SAMPLE_RATE", "2"},
+		{"ACCESS_LOG_FORMAT", "common"},
+	}
+	for _, test := range tests {
+		t.Run(test.name+"="+test.value, func(t *testing.T) {
+			unsetConfig(t)
+			t.Setenv(test.name, test.value)
+			_, err := LoadConfig()
+			if err == nil {
+				t.Fatal("LoadConfig() succeeded, want an error")
+			}
+			if !strings.Contains(err.Error(), "invalid "+test.name) {
+				t.Errorf("error = %v, want it to name %s", err, test.name)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissingTheKeyOfTheCertificate(t *testing.T) {
+	unsetConfig(t)
+	t.Setenv("TLS_CERT_FILE", "server.crt")
+	_, err := LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "both must be set") {
+		t.Errorf("error = %v, want both the certificate and key to be required", err)
+	}
+}
+
+func TestLoadConfigReportsEveryInvalidValue(t *testing.T) {
+	unsetConfig(t)
+	t.Setenv("HTTP_READ_TIMEOUT", "soon")
+	t.Setenv("RATE_LIMIT_BURST", "many")
+	t.Setenv("LISTEN_ADDR", "nowhere")
+	_, err := LoadConfig()
+	if err == nil {
+		t.Fatal("LoadConfig() succeeded, want an error")
+	}
+	for _, name := range []string{"HTTP_READ_TIMEOUT", "RATE_LIMIT_BURST", "LISTEN_ADDR"} {
+		if !strings.Contains(err.Error(), "invalid "+name) {
+			t.Errorf("error = %v, want it to name %s", err, name)
+		}
+	}
+}
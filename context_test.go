@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGetRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		want   string
+		wantOK bool
+	}{
+		{"stored", WithRequestID(context.Background(), "abc"), "abc", true},
+		{"absent", context.Background(), "", false},
+		{"not a string", context.WithValue(context.Background(), requestIDContextKey, 42), "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := GetRequestID(test.ctx)
+			if got != test.want || ok != test.wantOK {
+				t.Errorf("GetRequestID() = %q, %t, want %q, %t", got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestDoneStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"deadline exceeded", context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{"wrapped deadline exceeded", fmt.Errorf("querying: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{"canceled", context.Canceled, statusClientClosedRequest},
+		{"other", errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := doneStatus(test.err); got != test.want {
+				t.Errorf("doneStatus(%v) = %d, want %d", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestContextError(t *testing.T) {
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		want       error
+		wantReason string
+	}{
+		{"cancelled", cancelledContext(), context.Canceled, "canceled"},
+		{"deadline exceeded", expiredContext(), context.DeadlineExceeded, "deadline_exceeded"},
+		{"live", context.Background(), nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := contextError(test.ctx)
+			if !errors.Is(err, test.want) || (err == nil) != (test.want == nil) {
+				t.Fatalf("contextError() = %v, want %v", err, test.want)
+			}
+			if err != nil && doneReason(err) != test.wantReason {
+				t.Errorf("doneReason() = %q, want %q", doneReason(err), test.wantReason)
+			}
+		})
+	}
+}
+
+func TestDoneReasonOfAnUnexpectedError(t *testing.T) {
+	if got := doneReason(errors.New("boom")); got != "unexpected" {
+		t.Errorf("doneReason() = %q, want %q", got, "unexpected")
+	}
+}
+
+func TestPauseWithReport(t *testing.T) {
+	t.Run("completes", func(t *testing.T) {
+		waited, err := pauseWithReport(context.Background(), 20*time.Millisecond)
+		if err != nil || waited < 20*time.Millisecond {
+			t.Errorf("pauseWithReport() = %s, %v, want at least 20ms and no error", waited, err)
+		}
+	})
+	t.Run("cancelled before completing", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		waited, err := pauseWithReport(ctx, 5*time.Second)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("error = %v, want %v", err, context.Canceled)
+		}
+		if waited < 20*time.Millisecond || waited > time.Second {
+			t.Errorf("waited %s, want about the 20ms until it was cancelled", waited)
+		}
+	})
+}
+
+func TestContextValuesRoundTrip(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	ctx := context.Background()
+	ctx = WithRequestID(ctx, "request")
+	ctx = WithUserID(ctx, "user")
+	ctx = WithTraceID(ctx, "trace")
+	ctx = WithLogSampled(ctx, true)
+	ctx = WithRequestStart(ctx, start)
+
+	if got, ok := GetRequestID(ctx); got != "request" || !ok {
+		t.Errorf("GetRequestID() = %q, %t", got, ok)
+	}
+	if got, ok := GetUserID(ctx); got != "user" || !ok {
+		t.Errorf("GetUserID() = %q, %t", got, ok)
+	}
+	if got, ok := GetTraceID(ctx); got != "trace" || !ok {
+		t.Errorf("GetTraceID() = %q, %t", got, ok)
+	}
+	if got, ok := GetLogSampled(ctx); !got || !ok {
+		t.Errorf("GetLogSampled() = %t, %t", got, ok)
+	}
+	if got, ok := GetRequestStart(ctx); !got.Equal(start) || !ok {
+		t.Errorf("GetRequestStart() = %s, %t", got, ok)
+	}
+}
+
+func TestContextValuesAbsent(t *testing.T) {
+	// a key of another type with the same name doesn't collide with ours
+	ctx := context.WithValue(context.Background(), "request-id", "other")
+
+	if _, ok := GetRequestID(ctx); ok {
+		t.Error("GetRequestID() found a request id")
+	}
+	if _, ok := GetUserID(ctx); ok {
+		t.Error("GetUserID() found a user id")
+	}
+	if _, ok := GetTraceID(ctx); ok {
+		t.Error("GetTraceID() found a trace id")
+	}
+	if _, ok := GetLogSampled(ctx); ok {
+		t.Error("GetLogSampled() found a sampling decision")
+	}
+	if _, ok := GetRequestStart(ctx); ok {
+		t.Error("GetRequestStart() found a start time")
+	}
+	if _, ok := GetLogAttrs(ctx); ok {
+		t.Error("GetLogAttrs() found log fields")
+	}
+}
+
+func TestLogAttrsRoundTrip(t *testing.T) {
+	ctx := WithLogAttrs(context.Background())
+	AddLogAttrs(ctx, slog.Int("attempts", 1), slog.String("stage", "db"))
+	// a field added again replaces the earlier value
+	AddLogAttrs(ctx, slog.Int("attempts", 2))
+
+	attrs, ok := GetLogAttrs(ctx)
+	if !ok {
+		t.Fatal("GetLogAttrs() found no log fields")
+	}
+	got := map[string]string{}
+	for _, attr := range attrs {
+		got[attr.Key] = attr.Value.String()
+	}
+	if len(got) != 2 || got["attempts"] != "2" || got["stage"] != "db" {
+		t.Errorf("GetLogAttrs() = %v, want attempts 2 and stage db", attrs)
+	}
+
+	// adding to a context without log fields does nothing rather than panicking
+	AddLogAttrs(context.Background(), slog.Int("attempts", 1))
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testDatabasePool Returns a pool of the database of TEST_DATABASE_URL, such as the one of the docker compose file,
+// using the settings changed by configure. The test is skipped when it isn't set so go test passes without a database.
+func testDatabasePool(t testing.TB, configure func(*Config)) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("set TEST_DATABASE_URL to run the tests against a database")
+	}
+	config := defaultConfig()
+	config.DatabaseURL = url
+	if configure != nil {
+		configure(&config)
+	}
+	poolConfig, err := config.poolConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestDatabasePoolExhaustedFailsFast(t *testing.T) {
+	pool := testDatabasePool(t, func(config *Config) {
+		config.DatabaseMaxConns = 1
+	})
+	// hold the only connection so the request has to wait for one
+	held, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	s, _ := newTestServer(t, nil, func(config *Config) {
+		config.AcquireTimeout = 100 * time.Millisecond
+	})
+	s.people = newPgxPeopleRepository(pool, s.config.AcquireTimeout, s.config.QueryTimeout)
+	testServer := startTestServer(t, s)
+
+	start := time.Now()
+	response, body := do(t, http.MethodGet, testServer.URL+"/people/"+uuid.NewString(), "",
+		http.Header{requestTimeoutHeaderKey: {"5s"}})
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d: %s", response.StatusCode, http.StatusServiceUnavailable, body)
+	}
+	// the request gives up after the acquire timeout rather than waiting out its whole budget
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the request took %s, want it to fail fast", elapsed)
+	}
+}
+
+// testEmptyDatabasePool Returns a pool of the database of TEST_DATABASE_URL whose people table is empty.
+func testEmptyDatabasePool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	return testSchemaPool(t, "create table %s.people (like public.people including all)", nil)
+}
+
+// testSlowDatabasePool Returns a pool of the database of TEST_DATABASE_URL whose people take a second to query, so a
+// query can be made to run past a timeout.
+func testSlowDatabasePool(t *testing.T, configure func(*Config)) *pgxpool.Pool {
+	t.Helper()
+	return testSchemaPool(t, "create view %s.people as select name, id, created_at from public.people, pg_sleep(1)",
+		configure)
+}
+
+// testSchemaPool Returns a pool of the database of TEST_DATABASE_URL using the settings changed by configure, whose
+// connections look in a schema of their own before the public one. The statement, with %s standing for the schema,
+// creates the people of the schema so a test can change them while the people of the database are left alone.
+func testSchemaPool(t *testing.T, statement string, configure func(*Config)) *pgxpool.Pool {
+	t.Helper()
+	pool := testDatabasePool(t, nil)
+	ctx := context.Background()
+	schema := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	for _, sql := range []string{"create schema " + schema, fmt.Sprintf(statement, schema)} {
+		_, err := pool.Exec(ctx, sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// cleanups run last to first, so the schema is dropped before the pool used to drop it is closed
+	t.Cleanup(func() {
+		_, err := pool.Exec(context.Background(), "drop schema "+schema+" cascade")
+		if err != nil {
+			t.Errorf("dropping the test schema: %v", err)
+		}
+	})
+
+	config := defaultConfig()
+	config.DatabaseURL = os.Getenv("TEST_DATABASE_URL")
+	if configure != nil {
+		configure(&config)
+	}
+	poolConfig, err := config.poolConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	poolConfig.ConnConfig.RuntimeParams["search_path"] = schema
+	schemaPool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(schemaPool.Close)
+	return schemaPool
+}
+
+func TestDatabaseGetFromAnEmptyTable(t *testing.T) {
+	pool := testEmptyDatabasePool(t)
+	s, _ := newTestServer(t, nil, nil)
+	s.people = newPgxPeopleRepository(pool, s.config.AcquireTimeout, s.config.QueryTimeout)
+
+	_, err := s.people.Get(context.Background(), uuid.New())
+	if !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("error = %v, want %v", err, pgx.ErrNoRows)
+	}
+	response := serve(s, httptest.NewRequest(http.MethodGet, "/people/"+uuid.NewString(), nil))
+	if response.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d: %s", response.Code, http.StatusNotFound, response.Body)
+	}
+}
+
+func TestDatabaseQueryTimeoutAbortsASlowQuery(t *testing.T) {
+	pool := testSlowDatabasePool(t, nil)
+	const queryTimeout = 200 * time.Millisecond
+	people := newPgxPeopleRepository(pool, time.Second, queryTimeout)
+
+	// the caller's context has plenty of time left, only the query's own timeout stops it
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := people.First(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("the query took %s, want it aborted at the %s query timeout", elapsed, queryTimeout)
+	}
+	if ctx.Err() != nil {
+		t.Errorf("the caller's context is done: %v", ctx.Err())
+	}
+}
+
+func TestDatabaseSlowQueryRespondsWithGatewayTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestTimeout string
+		queryTimeout   time.Duration
+	}{
+		{"request deadline", "500ms", 10 * time.Second},
+		{"query timeout", "10s", 200 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := testSlowDatabasePool(t, nil)
+			s, _ := newTestServer(t, nil, func(config *Config) {
+				config.QueryTimeout = test.queryTimeout
+			})
+			s.people = newPgxPeopleRepository(pool, s.config.AcquireTimeout, s.config.QueryTimeout)
+			testServer := startTestServer(t, s)
+
+			response, body := do(t, http.MethodGet, testServer.URL+"/test", "",
+				http.Header{requestTimeoutHeaderKey: {test.requestTimeout}})
+			if response.StatusCode != http.StatusGatewayTimeout {
+				t.Errorf("status = %d, want %d: %s", response.StatusCode, http.StatusGatewayTimeout, body)
+			}
+		})
+	}
+}
+
+// BenchmarkDatabaseCallConnectingPerRequest Measures looking up a person the way it was done before the pool, with a
+// connection made for each request and closed once it is done.
+func BenchmarkDatabaseCallConnectingPerRequest(b *testing.B) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		b.Skip("set TEST_DATABASE_URL to run the benchmarks against a database")
+	}
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		connection, err := pgx.Connect(ctx, url)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var person Person
+		err = connection.QueryRow(ctx, personQuery).Scan(&person.Name, &person.ID, &person.CreatedAt)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			b.Fatal(err)
+		}
+		connection.Close(ctx)
+	}
+}
+
+// BenchmarkDatabaseCallPooled Measures looking up a person with a connection borrowed from the pool.
+func BenchmarkDatabaseCallPooled(b *testing.B) {
+	pool := testDatabasePool(b, nil)
+	config := defaultConfig()
+	people := newPgxPeopleRepository(pool, config.AcquireTimeout, config.QueryTimeout)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := people.First(ctx)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDatabaseStatementTimeoutAbortsASlowQuery(t *testing.T) {
+	const statementTimeout = 200 * time.Millisecond
+	pool := testSlowDatabasePool(t, func(config *Config) {
+		config.StatementTimeout = statementTimeout
+	})
+	// neither the caller's context nor the query's own timeout would stop the query before it finishes
+	people := newPgxPeopleRepository(pool, time.Second, 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := people.First(ctx)
+	if !isStatementTimeout(err) {
+		t.Errorf("error = %v, want the statement timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("the query took %s, want it aborted at the %s statement timeout", elapsed, statementTimeout)
+	}
+}
+
+func TestPoolConfigSetsTheStatementTimeout(t *testing.T) {
+	config := defaultConfig()
+	poolConfig, err := config.poolConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if poolConfig.AfterConnect != nil {
+		t.Error("the connections are set up, want the database's statement timeout kept")
+	}
+
+	config.StatementTimeout = 10 * time.Second
+	poolConfig, err = config.poolConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if poolConfig.AfterConnect == nil {
+		t.Error("the connections aren't set up, want the statement timeout set on each")
+	}
+}
+
+// startingDatabase A database that refuses to answer a ping until it has started.
+type startingDatabase struct {
+	startedAt time.Time
+	pings     atomic.Int32
+}
+
+func (d *startingDatabase) Ping(ctx context.Context) error {
+	d.pings.Add(1)
+	if time.Now().Before(d.startedAt) {
+		return errors.New("dial tcp 127.0.0.1:5432: connect: connection refused")
+	}
+	return ctx.Err()
+}
+
+func TestWaitForDatabaseRetriesUntilItStarts(t *testing.T) {
+	logs := &logBuffer{}
+	// the first ping fails, the second is made after the backoff once the database has started
+	database := &startingDatabase{startedAt: time.Now().Add(startupRetryBackoff / 2)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := waitForDatabase(ctx, database, newLogger(logs, slog.LevelInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := database.pings.Load(); got != 2 {
+		t.Errorf("pinged %d times, want 2", got)
+	}
+	warnings := logs.withMessage(t, "The database isn't available yet")
+	if len(warnings) != 1 || warnings[0]["attempt"] != float64(1) {
+		t.Errorf("warnings = %v, want one for the first attempt", warnings)
+	}
+	connected := logs.withMessage(t, "Connected to the database")
+	if len(connected) != 1 || connected[0]["attempt"] != float64(2) {
+		t.Errorf("connected records = %v, want one for the second attempt", connected)
+	}
+}
+
+func TestWaitForDatabaseGivesUpWhenTheStartupTimeRunsOut(t *testing.T) {
+	logs := &logBuffer{}
+	database := &startingDatabase{startedAt: time.Now().Add(time.Hour)}
+	ctx, cancel := context.WithTimeout(context.Background(), startupRetryBackoff/2)
+	defer cancel()
+
+	start := time.Now()
+	err := waitForDatabase(ctx, database, newLogger(logs, slog.LevelInfo))
+	if err == nil || !strings.Contains(err.Error(), "gave up after 1 attempts") ||
+		!strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("error = %v, want the error of the only attempt", err)
+	}
+	// the backoff is cut short by the startup time running out
+	if elapsed := time.Since(start); elapsed >= startupRetryBackoff {
+		t.Errorf("waited %s, want to give up once the startup time ran out", elapsed)
+	}
+}
@@ -1,8 +1,20 @@
-/* When the database starts up initialize it with a table named people containing one person named Amy */
+/* When the database starts up initialize it with a table named people containing one person named Amy, and an audit
+   table recording the background work of fire and forget */
 
 CREATE TABLE IF NOT EXISTS people (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
     name varchar(45) NOT NULL,
-    PRIMARY KEY (name)
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (id),
+    UNIQUE (name)
 );
 
-INSERT INTO people(name) VALUES ('Amy') ON CONFLICT DO NOTHING;
\ No newline at end of file
+INSERT INTO people(name) VALUES ('Amy') ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS audit (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    request_id varchar(64) NOT NULL,
+    event varchar(45) NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
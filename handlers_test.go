@@ -0,0 +1,1294 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// do Makes a request to the test server, returning the response with its body read.
+func do(t *testing.T, method, url, body string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	read, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, string(read)
+}
+
+func TestPoolExhaustedRespondsWithServiceUnavailable(t *testing.T) {
+	people := newFakePeople("Sam")
+	people.err = fmt.Errorf("acquiring a database connection: %w", errPoolExhausted)
+	s, _ := newTestServer(t, people, nil)
+	testServer := startTestServer(t, s)
+	id := people.people[0].ID.String()
+
+	for _, test := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodGet, "/test", ""},
+		{http.MethodGet, "/people", ""},
+		{http.MethodGet, "/export.csv", ""},
+		{http.MethodPost, "/people", `{"Name":"Al"}`},
+		{http.MethodPost, "/people/batch", `[{"Name":"Al"}]`},
+		{http.MethodGet, "/people/" + id, ""},
+		{http.MethodPut, "/people/" + id, `{"Name":"Al"}`},
+		{http.MethodDelete, "/people/" + id, ""},
+	} {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			response, body := do(t, test.method, testServer.URL+test.path, test.body, nil)
+			if response.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("status = %d, want %d: %s", response.StatusCode, http.StatusServiceUnavailable, body)
+			}
+		})
+	}
+}
+
+func TestCreatePerson(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"created", `{"Name":"Al"}`, http.StatusCreated},
+		{"no name", `{"Name":""}`, http.StatusBadRequest},
+		{"name too long", `{"Name":"` + strings.Repeat("a", maxNameLength+1) + `"}`, http.StatusBadRequest},
+		{"longest name", `{"Name":"` + strings.Repeat("é", maxNameLength) + `"}`, http.StatusCreated},
+		{"name taken", `{"Name":"Sam"}`, http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestServer(t, newFakePeople("Sam"), nil)
+			testServer := startTestServer(t, s)
+
+			response, body := do(t, http.MethodPost, testServer.URL+"/people", test.body, nil)
+			if response.StatusCode != test.status {
+				t.Errorf("status = %d, want %d: %s", response.StatusCode, test.status, body)
+			}
+		})
+	}
+}
+
+func TestUpdatePerson(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		body   string
+		status int
+	}{
+		{"updated", "", `{"Name":"Al"}`, http.StatusOK},
+		{"same name", "", `{"Name":"Sam"}`, http.StatusOK},
+		{"not found", uuid.NewString(), `{"Name":"Al"}`, http.StatusNotFound},
+		{"invalid id", "sam", `{"Name":"Al"}`, http.StatusBadRequest},
+		{"no name", "", `{"Name":""}`, http.StatusBadRequest},
+		{"name too long", "", `{"Name":"` + strings.Repeat("a", maxNameLength+1) + `"}`, http.StatusBadRequest},
+		{"name taken", "", `{"Name":"Jo"}`, http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			people := newFakePeople("Sam", "Jo")
+			s, _ := newTestServer(t, people, nil)
+			testServer := startTestServer(t, s)
+			id := test.id
+			if id == "" {
+				id = people.people[0].ID.String()
+			}
+
+			response, body := do(t, http.MethodPut, testServer.URL+"/people/"+id, test.body, nil)
+			if response.StatusCode != test.status {
+				t.Fatalf("status = %d, want %d: %s", response.StatusCode, test.status, body)
+			}
+			if test.status == http.StatusOK {
+				var person Person
+				err := json.Unmarshal([]byte(body), &person)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if person.ID.String() != id || person.Name != people.snapshot()[0].Name {
+					t.Errorf("person = %+v, want the saved person %+v", person, people.snapshot()[0])
+				}
+			}
+		})
+	}
+}
+
+func TestUpdatePersonCancelled(t *testing.T) {
+	people := newFakePeople("Sam")
+	s, _ := newTestServer(t, people, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// the client goes away while the update is waiting on the database
+	people.delay = time.Second
+	time.AfterFunc(50*time.Millisecond, cancel)
+	request := httptest.NewRequest(http.MethodPut, "/people/"+people.people[0].ID.String(),
+		strings.NewReader(`{"Name":"Al"}`)).WithContext(ctx)
+
+	start := time.Now()
+	recorder := serve(s, request)
+	if recorder.Code != statusClientClosedRequest {
+		t.Errorf("status = %d, want %d", recorder.Code, statusClientClosedRequest)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the update took %s, want it to stop when the request was cancelled", elapsed)
+	}
+	if name := people.snapshot()[0].Name; name != "Sam" {
+		t.Errorf("name = %q, want it unchanged", name)
+	}
+}
+
+func TestCreatePeople(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		inserted int64
+	}{
+		{"created", `[{"Name":"Al"},{"Name":"Jo"}]`, http.StatusCreated, 2},
+		{"no people", `[]`, http.StatusBadRequest, 0},
+		{"no name", `[{"Name":"Al"},{"Name":""}]`, http.StatusBadRequest, 0},
+		{"name too long", `[{"Name":"` + strings.Repeat("a", maxNameLength+1) + `"}]`, http.StatusBadRequest, 0},
+		{"name taken", `[{"Name":"Al"},{"Name":"Sam"}]`, http.StatusConflict, 0},
+		{"name given twice", `[{"Name":"Al"},{"Name":"Al"}]`, http.StatusConflict, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			people := newFakePeople("Sam")
+			s, _ := newTestServer(t, people, nil)
+			testServer := startTestServer(t, s)
+
+			response, body := do(t, http.MethodPost, testServer.URL+"/people/batch", test.body, nil)
+			if response.StatusCode != test.status {
+				t.Fatalf("status = %d, want %d: %s", response.StatusCode, test.status, body)
+			}
+			// the batch is all or nothing so only the person who was already there is left after a failure
+			if added := int64(len(people.snapshot()) - 1); added != test.inserted {
+				t.Errorf("%d people were added, want %d", added, test.inserted)
+			}
+		})
+	}
+}
+
+func TestPersonJSONHasItsIDAndCreatedAt(t *testing.T) {
+	person := Person{Name: "Sam", ID: uuid.MustParse("0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"),
+		CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	encoded, err := json.Marshal(person)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"Name":"Sam","id":"0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f","created_at":"2024-01-02T03:04:05Z"}`
+	if string(encoded) != want {
+		t.Errorf("json = %s, want %s", encoded, want)
+	}
+}
+
+// headerCounter Counts how many times the status is written.
+type headerCounter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *headerCounter) WriteHeader(status int) {
+	w.writes++
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func TestWriteJSONWritesTheStatusOnce(t *testing.T) {
+	s, _ := newTestServer(t, nil, nil)
+	tests := []struct {
+		name       string
+		value      any
+		wantStatus int
+		wantBody   bool
+	}{
+		{"encodable", Person{Name: "Sam"}, http.StatusCreated, true},
+		// a channel can't be encoded as json so building the body fails before anything is sent
+		{"not encodable", make(chan int), http.StatusInternalServerError, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+			err := s.writeJSON(response, http.StatusCreated, test.value)
+			if (err == nil) != test.wantBody {
+				t.Errorf("writeJSON() error = %v", err)
+			}
+			if response.Code != test.wantStatus || response.writes != 1 {
+				t.Errorf("status = %d written %d times, want %d written once", response.Code, response.writes,
+					test.wantStatus)
+			}
+			if (response.Body.Len() > 0) != test.wantBody {
+				t.Errorf("body = %q, want a body %t", response.Body, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestTestRespondsWithThePeople(t *testing.T) {
+	people := newFakePeople("Sam", "Alex")
+	s, _ := newTestServer(t, people, nil)
+	testServer := startTestServer(t, s)
+
+	response, body := do(t, http.MethodGet, testServer.URL+"/test", "", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", response.StatusCode, http.StatusOK, body)
+	}
+	if got := response.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("content type = %q, want application/json", got)
+	}
+	var got []Person
+	err := json.Unmarshal([]byte(body), &got)
+	if err != nil {
+		t.Fatalf("body %s isn't a json array of people: %v", body, err)
+	}
+	// the people from the database followed by the person from the rest call
+	want := append(people.snapshot(), Person{Name: "Paul"})
+	if len(got) != len(want) {
+		t.Fatalf("got %d people, want %d: %s", len(got), len(want), body)
+	}
+	for i := range want {
+		if got[i].Name != want[i].Name || got[i].ID != want[i].ID {
+			t.Errorf("person %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestNoPersonFoundRespondsWithNotFound(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople(), nil)
+	testServer := startTestServer(t, s)
+
+	for _, test := range []struct{ name, path string }{
+		{"get person", "/people/" + uuid.NewString()},
+		{"parallel", "/parallel"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			response, body := do(t, http.MethodGet, testServer.URL+test.path, "", nil)
+			if response.StatusCode != http.StatusNotFound {
+				t.Errorf("status = %d, want %d: %s", response.StatusCode, http.StatusNotFound, body)
+			}
+			var errorResponse ErrorResponse
+			err := json.Unmarshal([]byte(body), &errorResponse)
+			if err != nil || !strings.Contains(errorResponse.Error, "no person was found") {
+				t.Errorf("body = %s, want an error saying no person was found", body)
+			}
+		})
+	}
+}
+
+func TestTestLogsTheStageTheClientDisconnectedDuring(t *testing.T) {
+	tests := []struct {
+		stage   string
+		dbDelay time.Duration
+	}{
+		{"db", 5 * time.Second},
+		{"rest", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.stage, func(t *testing.T) {
+			people := newFakePeople("Sam")
+			people.delay = test.dbDelay
+			s, logs := newTestServer(t, people, nil)
+			// the server side get only responds once the rest call has been given up on
+			startUpstream(t, s, func(response http.ResponseWriter, request *http.Request) {
+				<-request.Context().Done()
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			response := serve(s, httptest.NewRequest(http.MethodGet, "/test", nil).WithContext(ctx))
+
+			if response.Code != statusClientClosedRequest {
+				t.Errorf("status = %d, want %d", response.Code, statusClientClosedRequest)
+			}
+			message := "Client disconnected during " + test.stage + " call"
+			records := logs.withMessage(t, message)
+			if len(records) != 1 || records[0]["level"] != "WARN" {
+				t.Errorf("logged %q %d times, want once as a warning: %v", message, len(records), records)
+			}
+		})
+	}
+}
+
+func TestTestLogsTheDoneContextOnce(t *testing.T) {
+	people := newFakePeople("Sam")
+	people.delay = 5 * time.Second
+	s, logs := newTestServer(t, people, nil)
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	// long enough to be over the headroom so the database call is started
+	request.Header.Set(requestTimeoutHeaderKey, "200ms")
+	response := serve(s, request)
+	if response.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want %d", response.Code, http.StatusGatewayTimeout)
+	}
+
+	// the database call, the check of the context and the response all see the context is done, only one of them logs it
+	var problems []map[string]any
+	for _, record := range logs.records(t) {
+		if record["level"] == "WARN" || record["level"] == "ERROR" {
+			problems = append(problems, record)
+		}
+	}
+	if len(problems) != 1 || problems[0]["msg"] != "The get context has timed out" {
+		t.Errorf("logged %v, want the timeout logged once", problems)
+	}
+}
+
+func TestDeletePerson(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		status int
+		left   int
+	}{
+		{"deleted", "", http.StatusNoContent, 1},
+		{"no rows", uuid.NewString(), http.StatusNotFound, 2},
+		{"invalid id", "sam", http.StatusBadRequest, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			people := newFakePeople("Sam", "Jo")
+			s, _ := newTestServer(t, people, nil)
+			id := test.id
+			if id == "" {
+				id = people.people[0].ID.String()
+			}
+
+			recorder := serve(s, httptest.NewRequest(http.MethodDelete, "/people/"+id, nil))
+			if recorder.Code != test.status {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+			if left := len(people.snapshot()); left != test.left {
+				t.Errorf("%d people are left, want %d", left, test.left)
+			}
+		})
+	}
+}
+
+func TestDeletePersonCancelled(t *testing.T) {
+	people := newFakePeople("Sam")
+	s, _ := newTestServer(t, people, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// the client goes away while the delete is waiting on the database
+	people.delay = time.Second
+	time.AfterFunc(50*time.Millisecond, cancel)
+	request := httptest.NewRequest(http.MethodDelete, "/people/"+people.people[0].ID.String(), nil).WithContext(ctx)
+
+	start := time.Now()
+	recorder := serve(s, request)
+	if recorder.Code != statusClientClosedRequest {
+		t.Errorf("status = %d, want %d", recorder.Code, statusClientClosedRequest)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the delete took %s, want it to stop when the request was cancelled", elapsed)
+	}
+	if left := len(people.snapshot()); left != 1 {
+		t.Errorf("%d people are left, want the person kept", left)
+	}
+}
+
+func TestHandlersRespondToADoneContext(t *testing.T) {
+	people := newFakePeople("Sam")
+	s, _ := newTestServer(t, people, nil)
+	id := people.people[0].ID.String()
+
+	contexts := []struct {
+		name   string
+		ctx    context.Context
+		status int
+	}{
+		{"cancelled", cancelledContext(), statusClientClosedRequest},
+		{"expired", expiredContext(), http.StatusGatewayTimeout},
+	}
+	requests := []struct {
+		name, method, path, body string
+	}{
+		{"test", http.MethodGet, "/test", ""},
+		{"get person", http.MethodGet, "/people/" + id, ""},
+		{"update person", http.MethodPut, "/people/" + id, `{"Name":"Al"}`},
+		{"delete person", http.MethodDelete, "/people/" + id, ""},
+		{"create person", http.MethodPost, "/people", `{"Name":"Al"}`},
+	}
+	for _, done := range contexts {
+		for _, request := range requests {
+			t.Run(done.name+" "+request.name, func(t *testing.T) {
+				recorder := serve(s, httptest.NewRequest(request.method, request.path,
+					strings.NewReader(request.body)).WithContext(done.ctx))
+				if recorder.Code != done.status {
+					t.Errorf("status = %d, want %d: %s", recorder.Code, done.status, recorder.Body)
+				}
+			})
+		}
+	}
+	if got := people.snapshot(); len(got) != 1 || got[0].Name != "Sam" {
+		t.Errorf("people = %+v, want them unchanged", got)
+	}
+}
+
+func TestTestNegotiatesTheContentType(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople("Sam"), nil)
+	testServer := startTestServer(t, s)
+
+	tests := []struct {
+		accept      string
+		contentType string
+	}{
+		{"application/json", "application/json"},
+		{"application/xml", "application/xml"},
+		{"text/xml;q=0.9, application/json", "application/xml"},
+		{"application/json, application/xml", "application/json"},
+		// an accept header asking for neither falls back to json rather than a 406
+		{"text/csv", "application/json"},
+		{"", "application/json"},
+	}
+	for _, test := range tests {
+		t.Run(test.accept, func(t *testing.T) {
+			response, body := do(t, http.MethodGet, testServer.URL+"/test", "", http.Header{"Accept": {test.accept}})
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", response.StatusCode, http.StatusOK, body)
+			}
+			if got := response.Header.Get("Content-Type"); got != test.contentType {
+				t.Fatalf("content type = %q, want %q", got, test.contentType)
+			}
+
+			var names []string
+			if test.contentType == "application/xml" {
+				var people People
+				err := xml.Unmarshal([]byte(body), &people)
+				if err != nil {
+					t.Fatalf("body %s isn't xml: %v", body, err)
+				}
+				for _, person := range people.People {
+					names = append(names, person.Name)
+				}
+			} else {
+				var people []Person
+				err := json.Unmarshal([]byte(body), &people)
+				if err != nil {
+					t.Fatalf("body %s isn't json: %v", body, err)
+				}
+				for _, person := range people {
+					names = append(names, person.Name)
+				}
+			}
+			if strings.Join(names, ",") != "Sam,Paul" {
+				t.Errorf("names = %v, want Sam and Paul", names)
+			}
+		})
+	}
+}
+
+// manyPeople Returns the names of count people.
+func manyPeople(count int) []string {
+	names := make([]string, count)
+	for i := range names {
+		names[i] = fmt.Sprintf("Person %d", i)
+	}
+	return names
+}
+
+func TestListPeopleStreamsManyRows(t *testing.T) {
+	const total = 1000
+	s, _ := newTestServer(t, newFakePeople(manyPeople(total)...), nil)
+
+	recorder := serve(s, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/people?limit=%d", maxPageLimit), nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	var page struct {
+		People     []Person
+		NextOffset *int `json:"next_offset"`
+	}
+	err := json.Unmarshal(recorder.Body.Bytes(), &page)
+	if err != nil {
+		t.Fatalf("the stream isn't json: %v", err)
+	}
+	if len(page.People) != total || page.NextOffset != nil {
+		t.Errorf("streamed %d people with the next offset %v, want all %d and no next page", len(page.People),
+			page.NextOffset, total)
+	}
+	if trailer := recorder.Result().Trailer; trailer.Get(streamErrorTrailerKey) != "" {
+		t.Errorf("stream error trailer = %q, want none", trailer.Get(streamErrorTrailerKey))
+	}
+}
+
+func TestListPeopleStopsStreamingWhenCancelled(t *testing.T) {
+	const total = 1000
+	people := newFakePeople(manyPeople(total)...)
+	people.rowDelay = time.Millisecond
+	s, _ := newTestServer(t, people, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	recorder := serve(s, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/people?limit=%d", maxPageLimit),
+		nil).WithContext(ctx))
+
+	if read := people.read.Load(); read >= total {
+		t.Errorf("read %d rows, want the stream to stop partway through the %d", read, total)
+	}
+	// the status was sent before the stream started, the trailer tells the client it was cut short
+	if trailer := recorder.Result().Trailer; trailer.Get(streamErrorTrailerKey) != context.Canceled.Error() {
+		t.Errorf("stream error trailer = %q, want %q", trailer.Get(streamErrorTrailerKey), context.Canceled)
+	}
+	if json.Valid(recorder.Body.Bytes()) {
+		t.Error("the stream is complete json, want it cut short")
+	}
+}
+
+func TestTestRespondsWithGatewayTimeoutWhenTheQueryTimesOut(t *testing.T) {
+	people := newFakePeople("Sam")
+	// the way pgx reports a query whose own context ran out, while the request still has time left
+	people.fail(fmt.Errorf("querying people: %w", fmt.Errorf("timeout: %w", context.DeadlineExceeded)))
+	s, _ := newTestServer(t, people, nil)
+
+	recorder := serve(s, httptest.NewRequest(http.MethodGet, "/test", nil))
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusGatewayTimeout)
+	}
+	if !strings.Contains(recorder.Body.String(), "the database query timed out") {
+		t.Errorf("body = %s, want the query timeout error", recorder.Body)
+	}
+}
+
+// adminKey The admin key of the servers of the cancel tests.
+const adminKey = "test-admin-key"
+
+// startSlowRequest Makes a request to slow in the background with the context, with the request id header when one is
+// given, and returns the channel its status is sent to once it responds. The status is 0 when the context was done
+// first. It returns once the server is handling the request.
+func startSlowRequest(t *testing.T, ctx context.Context, s *Server, url, requestID string) <-chan int {
+	t.Helper()
+	status := make(chan int, 1)
+	go func() {
+		request, _ := http.NewRequestWithContext(ctx, http.MethodGet, url+"/slow?delay=5s", nil)
+		if requestID != "" {
+			request.Header.Set(requestIDHeaderKey, requestID)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			if ctx.Err() == nil {
+				t.Errorf("slow request failed: %v", err)
+			}
+			status <- 0
+			return
+		}
+		response.Body.Close()
+		status <- response.StatusCode
+	}()
+	waitForHandling(t, s, 1)
+	return status
+}
+
+// firstRequestID Returns a request id generator creating the request id for the first request and a unique one for
+// each after it, so the request to cancel has a known id and the cancel request doesn't share it.
+func firstRequestID(requestID string) func() string {
+	var used atomic.Bool
+	return func() string {
+		if used.CompareAndSwap(false, true) {
+			return requestID
+		}
+		return uuid.NewString()
+	}
+}
+
+// assertStillRunning Fails the test when the request has already responded.
+func assertStillRunning(t *testing.T, status <-chan int) {
+	t.Helper()
+	select {
+	case got := <-status:
+		t.Errorf("slow responded with %d, want it left running", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople(), func(config *Config) {
+		config.AdminKey = adminKey
+	})
+	const requestID = "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"
+	// only the request ids the server creates can be cancelled
+	s.idGenerator = firstRequestID(requestID)
+	testServer := startTestServer(t, s)
+	admin := http.Header{adminKeyHeaderKey: {adminKey}}
+
+	start := time.Now()
+	status := startSlowRequest(t, context.Background(), s, testServer.URL, "")
+	response, body := do(t, http.MethodPost, testServer.URL+"/cancel/"+requestID, "", admin)
+	if response.StatusCode != http.StatusAccepted {
+		t.Fatalf("cancel status = %d, want %d: %s", response.StatusCode, http.StatusAccepted, body)
+	}
+	got := <-status
+	if elapsed := time.Since(start); got != statusClientClosedRequest || elapsed > time.Second {
+		t.Errorf("slow responded with %d after %s, want %d straight after it was cancelled", got, elapsed,
+			statusClientClosedRequest)
+	}
+
+	// the request has finished so there is nothing left to cancel
+	response, _ = do(t, http.MethodPost, testServer.URL+"/cancel/"+requestID, "", admin)
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("status cancelling a finished request = %d, want %d", response.StatusCode, http.StatusNotFound)
+	}
+	response, _ = do(t, http.MethodPost, testServer.URL+"/cancel/not-a-uuid", "", admin)
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("status cancelling an invalid id = %d, want %d", response.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestCancelRequestRequiresTheAdminKey(t *testing.T) {
+	const requestID = "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"
+	tests := []struct {
+		name     string
+		adminKey string
+		header   http.Header
+		status   int
+	}{
+		{"no admin key set", "", http.Header{adminKeyHeaderKey: {""}}, http.StatusForbidden},
+		{"no admin key sent", adminKey, nil, http.StatusUnauthorized},
+		{"wrong admin key", adminKey, http.Header{adminKeyHeaderKey: {"guess"}}, http.StatusUnauthorized},
+		{"an api key", adminKey, http.Header{apiKeyHeaderKey: {adminKey}}, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestServer(t, newFakePeople(), func(config *Config) {
+				config.AdminKey = test.adminKey
+			})
+			s.idGenerator = firstRequestID(requestID)
+			testServer := startTestServer(t, s)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			status := startSlowRequest(t, ctx, s, testServer.URL, "")
+			response, body := do(t, http.MethodPost, testServer.URL+"/cancel/"+requestID, "", test.header)
+			if response.StatusCode != test.status {
+				t.Errorf("cancel status = %d, want %d: %s", response.StatusCode, test.status, body)
+			}
+			assertStillRunning(t, status)
+			// stop the slow request the way its client would, so the test doesn't wait out its delay
+			cancel()
+			<-status
+		})
+	}
+}
+
+func TestCancelRequestCantCancelAClientChosenRequestID(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople(), func(config *Config) {
+		config.AdminKey = adminKey
+	})
+	testServer := startTestServer(t, s)
+	// another client could send the same request id, so cancelling it could stop someone else's request
+	const requestID = "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	status := startSlowRequest(t, ctx, s, testServer.URL, requestID)
+	response, body := do(t, http.MethodPost, testServer.URL+"/cancel/"+requestID, "",
+		http.Header{adminKeyHeaderKey: {adminKey}})
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("cancel status = %d, want %d: %s", response.StatusCode, http.StatusNotFound, body)
+	}
+	assertStillRunning(t, status)
+	cancel()
+	<-status
+}
+
+func TestListPeoplePages(t *testing.T) {
+	people := newFakePeople(manyPeople(250)...)
+	s, _ := newTestServer(t, people, nil)
+
+	tests := []struct {
+		name       string
+		query      string
+		status     int
+		first      string
+		count      int
+		nextOffset *int
+	}{
+		{"default page", "", http.StatusOK, "Person 0", defaultPageLimit, intPointer(defaultPageLimit)},
+		{"explicit page", "?limit=20&offset=40", http.StatusOK, "Person 40", 20, intPointer(60)},
+		{"last page", "?limit=100&offset=200", http.StatusOK, "Person 200", 50, nil},
+		{"past the end", "?offset=300", http.StatusOK, "", 0, nil},
+		{"limit not a number", "?limit=ten", http.StatusBadRequest, "", 0, nil},
+		{"limit zero", "?limit=0", http.StatusBadRequest, "", 0, nil},
+		{"limit too large", fmt.Sprintf("?limit=%d", maxPageLimit+1), http.StatusBadRequest, "", 0, nil},
+		{"negative offset", "?offset=-1", http.StatusBadRequest, "", 0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := serve(s, httptest.NewRequest(http.MethodGet, "/people"+test.query, nil))
+			if recorder.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			var page struct {
+				People     []Person
+				NextOffset *int `json:"next_offset"`
+			}
+			err := json.Unmarshal(recorder.Body.Bytes(), &page)
+			if err != nil {
+				t.Fatalf("the page isn't json: %v", err)
+			}
+			if len(page.People) != test.count || (test.count > 0 && page.People[0].Name != test.first) {
+				t.Errorf("page has %d people, want %d starting with %q", len(page.People), test.count, test.first)
+			}
+			if (page.NextOffset == nil) != (test.nextOffset == nil) ||
+				(page.NextOffset != nil && *page.NextOffset != *test.nextOffset) {
+				t.Errorf("next offset = %v, want %v", page.NextOffset, test.nextOffset)
+			}
+		})
+	}
+}
+
+// intPointer Returns a pointer to the number, for the next offset a page is expected to have.
+func intPointer(number int) *int {
+	return &number
+}
+
+func TestErrorResponseEnvelope(t *testing.T) {
+	people := newFakePeople("Sam")
+	people.fail(errors.New("the database broke"))
+	s, _ := newTestServer(t, people, nil)
+	const requestID = "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"
+
+	request := httptest.NewRequest(http.MethodGet, "/people/"+people.people[0].ID.String(), nil)
+	request.Header.Set(requestIDHeaderKey, requestID)
+	recorder := serve(s, request)
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+	if got := recorder.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("content type = %q, want application/json", got)
+	}
+	// the envelope has exactly these fields, and the cause of the error isn't leaked to the client
+	want := `{"error":"an internal error occurred","request_id":"` + requestID + `"}`
+	if got := strings.TrimSpace(recorder.Body.String()); got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+}
+
+func TestSeparateServerSideGet(t *testing.T) {
+	serverSide, serverSideLogs := newTestServer(t, nil, nil)
+	serverSideTestServer := httptest.NewServer(serverSide.newRouter(true))
+	defer serverSideTestServer.Close()
+
+	s, logs := newTestServer(t, newFakePeople("Sam"), func(config *Config) {
+		config.ServerSideBaseURL = serverSideTestServer.URL
+	})
+	testServer := httptest.NewServer(s.newRouter(false))
+	defer testServer.Close()
+
+	const requestID = "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"
+	response, body := do(t, http.MethodGet, testServer.URL+"/test", "", http.Header{requestIDHeaderKey: {requestID}})
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", response.StatusCode, http.StatusOK, body)
+	}
+	if records := logs.withMessage(t, "Get was called"); len(records) != 1 || records[0]["request_id"] != requestID {
+		t.Errorf("test records = %v, want one with the request id %s", records, requestID)
+	}
+	records := serverSideLogs.withMessage(t, "Server side get was called")
+	if len(records) != 1 || records[0]["request_id"] != requestID {
+		t.Errorf("server side get records = %v, want one with the request id %s", records, requestID)
+	}
+
+	// the server side application only serves the server side get
+	response, _ = do(t, http.MethodGet, serverSideTestServer.URL+"/test", "", nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("status of test on the server side = %d, want %d", response.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestCallsAreSkippedWithoutHeadroom(t *testing.T) {
+	people := newFakePeople("Sam")
+	s, _ := newTestServer(t, people, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.MinDeadlineHeadroom/2)
+	defer cancel()
+
+	_, err := s.databaseCall(ctx)
+	if !errors.Is(err, errNoHeadroom) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("database call error = %v, want %v wrapping %v", err, errNoHeadroom, context.DeadlineExceeded)
+	}
+	_, err = s.restCall(ctx)
+	if !errors.Is(err, errNoHeadroom) {
+		t.Errorf("rest call error = %v, want %v", err, errNoHeadroom)
+	}
+	if got := people.calls.Load(); got != 0 {
+		t.Errorf("made %d database calls, want none", got)
+	}
+}
+
+func TestTestRespondsWithGatewayTimeoutWithoutHeadroom(t *testing.T) {
+	people := newFakePeople("Sam")
+	s, logs := newTestServer(t, people, nil)
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	// less than the headroom is left from the start, so the database call is never made
+	request.Header.Set(requestTimeoutHeaderKey, "10ms")
+	response := serve(s, request)
+	if response.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want %d", response.Code, http.StatusGatewayTimeout)
+	}
+	if got := people.calls.Load(); got != 0 {
+		t.Errorf("made %d database calls, want none", got)
+	}
+	if records := logs.withMessage(t, "Not enough time was left to make the call"); len(records) != 1 {
+		t.Errorf("logged %d skipped calls, want 1", len(records))
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	person := Person{Name: "Sam & <Co>", ID: uuid.MustParse("0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"),
+		CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	tests := []struct {
+		name   string
+		pretty bool
+		want   string
+	}{
+		{"compact", false,
+			`{"Name":"Sam & <Co>","id":"0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f","created_at":"2024-01-02T03:04:05Z"}` + "\n"},
+		{"pretty", true, `{
+  "Name": "Sam & <Co>",
+  "id": "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f",
+  "created_at": "2024-01-02T03:04:05Z"
+}
+`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			people := &fakePeople{people: []Person{person}}
+			s, _ := newTestServer(t, people, func(config *Config) {
+				config.PrettyJSON = test.pretty
+			})
+
+			response := serve(s, httptest.NewRequest(http.MethodGet, "/people/"+person.ID.String(), nil))
+			if response.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", response.Code, http.StatusOK)
+			}
+			// the html characters are left as they are rather than escaped
+			if got := response.Body.String(); got != test.want {
+				t.Errorf("body = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestListPeopleSendsTrailers(t *testing.T) {
+	const requestID = "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"
+	tests := []struct {
+		name           string
+		rowDelay       time.Duration
+		requestTimeout string
+		wantErr        string
+	}{
+		{"complete", 0, "", ""},
+		// the deadline passes once the first rows have been streamed, the status has already been sent by then
+		{"cut short", 10 * time.Millisecond, "200ms", context.DeadlineExceeded.Error()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			people := newFakePeople(manyPeople(100)...)
+			people.rowDelay = test.rowDelay
+			s, _ := newTestServer(t, people, nil)
+			testServer := startTestServer(t, s)
+
+			header := http.Header{requestIDHeaderKey: {requestID}}
+			if test.requestTimeout != "" {
+				header.Set(requestTimeoutHeaderKey, test.requestTimeout)
+			}
+			// the trailers are only filled in once the whole body has been read
+			response, _ := do(t, http.MethodGet, testServer.URL+"/people?limit=100", "", header)
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", response.StatusCode, http.StatusOK)
+			}
+			if got := response.Trailer.Get(requestIDHeaderKey); got != requestID {
+				t.Errorf("request id trailer = %q, want %q", got, requestID)
+			}
+			if got := response.Trailer.Get(streamErrorTrailerKey); got != test.wantErr {
+				t.Errorf("stream error trailer = %q, want %q", got, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestTestRespondsWithGatewayTimeoutWhenTheStatementTimesOut(t *testing.T) {
+	people := newFakePeople("Sam")
+	// the way the database reports aborting a statement for running past the statement timeout
+	people.fail(fmt.Errorf("querying people: %w",
+		&pgconn.PgError{Code: queryCanceledCode, Message: "canceling statement due to statement timeout"}))
+	s, _ := newTestServer(t, people, nil)
+
+	response := serve(s, httptest.NewRequest(http.MethodGet, "/test", nil))
+	if response.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d: %s", response.Code, http.StatusGatewayTimeout, response.Body)
+	}
+}
+
+func TestAggregateRespondsWithPartialResults(t *testing.T) {
+	tests := []struct {
+		name         string
+		databaseErr  error
+		restDelay    time.Duration
+		wantDatabase string
+		wantRest     string
+	}{
+		{"every source answers", nil, 0, "", ""},
+		{"the rest calls time out", nil, 5 * time.Second, "", "timed out"},
+		{"the database fails", errors.New("connection reset"), 0, "failed", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			people := newFakePeople("Alex")
+			people.fail(test.databaseErr)
+			s, _ := newTestServer(t, people, func(config *Config) {
+				config.AggregateSourceTimeout = 200 * time.Millisecond
+			})
+			startUpstream(t, s, func(response http.ResponseWriter, request *http.Request) {
+				_ = pause(request.Context(), test.restDelay)
+				respondWithPerson(response, request)
+			})
+
+			start := time.Now()
+			response := serve(s, httptest.NewRequest(http.MethodGet, "/aggregate", nil))
+			// the request isn't held up by a source for longer than the source may take
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("aggregate took %s, want at most about the source timeout", elapsed)
+			}
+			if response.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", response.Code, http.StatusOK, response.Body)
+			}
+			var results []SourceResult
+			err := json.Unmarshal(response.Body.Bytes(), &results)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 3 {
+				t.Fatalf("results = %+v, want one for each of the 3 sources", results)
+			}
+			for _, result := range results {
+				want, name := test.wantRest, "Sam"
+				if result.Source == "db" {
+					want, name = test.wantDatabase, "Alex"
+				}
+				if result.Error != want {
+					t.Errorf("error of %s = %q, want %q", result.Source, result.Error, want)
+				}
+				if want == "" && (result.Person == nil || result.Person.Name != name) {
+					t.Errorf("person of %s = %v, want %s", result.Source, result.Person, name)
+				}
+				if want != "" && result.Person != nil {
+					t.Errorf("person of %s = %v, want none", result.Source, result.Person)
+				}
+			}
+		})
+	}
+}
+
+func TestSourceFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("querying a person: %w", context.DeadlineExceeded), "timed out"},
+		{&pgconn.PgError{Code: queryCanceledCode}, "timed out"},
+		{errCircuitOpen, "unavailable"},
+		{errPoolExhausted, "unavailable"},
+		{pgx.ErrNoRows, "not found"},
+		{errors.New("connection reset"), "failed"},
+	}
+	for _, test := range tests {
+		if got := sourceFailure(test.err); got != test.want {
+			t.Errorf("sourceFailure(%v) = %q, want %q", test.err, got, test.want)
+		}
+	}
+}
+
+func TestCreatePersonDescribesTheBodyProblem(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"empty", "", "the request body is empty, it must be a person"},
+		{"malformed", `{"Name":"Al",}`, "the request body is not valid json at byte 14"},
+		{"cut short", `{"Name":"Al"`, "the request body is not valid json, it ends part way through"},
+		{"unknown field", `{"Name":"Al","Age":3}`, `the request body has the unknown field "Age"`},
+		{"wrong field type", `{"Name":3}`, "the Name field must be a json string, not a json number"},
+		{"wrong id type", `{"Name":"Al","id":3}`, "the id field must be a json string, not a json number"},
+		{"wrong body type", `["Al"]`, "the request body must be a person, not a json array"},
+		{"invalid id", `{"Name":"Al","id":"abc"}`, "the request body must be a person: invalid UUID length: 3"},
+		{"two values", `{"Name":"Al"} {"Name":"Jo"}`, "the request body must be a single json value holding a person"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestServer(t, newFakePeople(), nil)
+
+			response := serve(s, httptest.NewRequest(http.MethodPost, "/people", strings.NewReader(test.body)))
+			if response.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d: %s", response.Code, http.StatusBadRequest, response.Body)
+			}
+			var envelope ErrorResponse
+			err := json.Unmarshal(response.Body.Bytes(), &envelope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if envelope.Error != test.want {
+				t.Errorf("error = %q, want %q", envelope.Error, test.want)
+			}
+		})
+	}
+}
+
+func TestDetachedTaskFinishesAfterTheClientCancels(t *testing.T) {
+	const requestID = "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"
+	s, logs := newTestServer(t, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	request := httptest.NewRequest(http.MethodGet, "/detach", nil).WithContext(ctx)
+	request.Header.Set(requestIDHeaderKey, requestID)
+	start := time.Now()
+	serve(s, request)
+
+	// the handler waited for the task rather than returning once the client went away
+	if elapsed := time.Since(start); elapsed < detachTaskDuration {
+		t.Errorf("detach returned after %s, want the %s task to have run", elapsed, detachTaskDuration)
+	}
+	if records := logs.withMessage(t, "The detached task was stopped"); len(records) != 0 {
+		t.Errorf("the detached task was stopped: %v", records)
+	}
+	records := logs.withMessage(t, "The detached task has finished")
+	if len(records) != 1 || records[0]["request_id"] != requestID {
+		t.Errorf("finished records = %v, want one with the request id %s", records, requestID)
+	}
+	if records := logs.withMessage(t, "The get context was canceled"); len(records) != 1 {
+		t.Errorf("logged the cancelled request %d times, want once", len(records))
+	}
+}
+
+func TestFireAndForgetAuditIsWrittenAfterTheClientHasGone(t *testing.T) {
+	const requestID = "5d0c1f7a-8b3e-4c2d-9a61-7e4f3b2a1c0d"
+	people := newFakePeople()
+	// the audit is still being written once the request has responded and its context is done
+	people.delay = 100 * time.Millisecond
+	s, logs := newTestServer(t, people, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request := httptest.NewRequest(http.MethodGet, "/fire-and-forget", nil).WithContext(ctx)
+	request.Header.Set(requestIDHeaderKey, requestID)
+	response := serve(s, request)
+	// the client goes away as soon as it has the response, like the server does with the request context
+	cancel()
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", response.Code, http.StatusAccepted)
+	}
+	s.background.Wait()
+
+	want := []fakeAudit{{requestID: requestID, event: "fire-and-forget"}}
+	if got := people.audited(); !reflect.DeepEqual(got, want) {
+		t.Errorf("audits = %v, want %v", got, want)
+	}
+	records := logs.withMessage(t, "Fire and forget has written the audit record")
+	if len(records) != 1 || records[0]["request_id"] != requestID {
+		t.Errorf("written records = %v, want one with the request id %s", records, requestID)
+	}
+}
+
+func TestCreatePersonAuditsTheCreatedPerson(t *testing.T) {
+	const requestID = "9e8d7c6b-5a4f-4e3d-8c2b-1a0f9e8d7c6b"
+	people := newFakePeople()
+	s, logs := newTestServer(t, people, nil)
+	s.startWorkers(1)
+
+	request := httptest.NewRequest(http.MethodPost, "/people", strings.NewReader(`{"Name":"Al"}`))
+	request.Header.Set(requestIDHeaderKey, requestID)
+	response := serve(s, request)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", response.Code, http.StatusCreated, response.Body)
+	}
+
+	// the job is run by a worker after the response, so it is given a moment to finish
+	deadline := time.Now().Add(2 * time.Second)
+	for len(people.audited()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := []fakeAudit{{requestID: requestID, event: "person-created"}}
+	if got := people.audited(); !reflect.DeepEqual(got, want) {
+		t.Errorf("audits = %v, want %v", got, want)
+	}
+	s.stopWorkers()
+	s.background.Wait()
+	records := logs.withMessage(t, "Finished the audit job")
+	if len(records) != 1 || records[0]["request_id"] != requestID {
+		t.Errorf("finished records = %v, want one with the request id %s", records, requestID)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		want       string
+	}{
+		{"database reachable", nil, http.StatusOK, "ok"},
+		{"database unreachable", errors.New("connection refused"), http.StatusServiceUnavailable, "unavailable"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			people := newFakePeople()
+			people.fail(test.err)
+			s, _ := newTestServer(t, people, nil)
+
+			response := serve(s, httptest.NewRequest(http.MethodGet, "/health", nil))
+			var health HealthStatus
+			err := json.Unmarshal(response.Body.Bytes(), &health)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Code != test.wantStatus || health.Status != test.want {
+				t.Errorf("health = %d %q, want %d %q", response.Code, health.Status, test.wantStatus, test.want)
+			}
+			if calls := people.calls.Load(); calls != 1 {
+				t.Errorf("pinged %d times, want once", calls)
+			}
+		})
+	}
+}
+
+func TestHandlersAbandonTheRepositoryCallWhenTheClientCancels(t *testing.T) {
+	requests := []struct {
+		name, method, path, body string
+	}{
+		{"test", http.MethodGet, "/test", ""},
+		{"list people", http.MethodGet, "/people", ""},
+		{"get person", http.MethodGet, "/people/" + uuid.NewString(), ""},
+		{"create person", http.MethodPost, "/people", `{"Name":"Al"}`},
+		{"delete person", http.MethodDelete, "/people/" + uuid.NewString(), ""},
+	}
+	for _, request := range requests {
+		t.Run(request.name, func(t *testing.T) {
+			people := newFakePeople("Sam")
+			// far longer than the test, the call only ends early because the context it was given is done
+			people.delay = 5 * time.Second
+			s, _ := newTestServer(t, people, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			start := time.Now()
+			recorder := serve(s, httptest.NewRequest(request.method, request.path,
+				strings.NewReader(request.body)).WithContext(ctx))
+
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("the handler took %s, want it to stop once the client cancelled", elapsed)
+			}
+			if people.calls.Load() != 1 {
+				t.Errorf("made %d repository calls, want 1", people.calls.Load())
+			}
+			if recorder.Code != statusClientClosedRequest {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, statusClientClosedRequest, recorder.Body)
+			}
+		})
+	}
+}
+
+func TestHandlersRespondToARepositoryError(t *testing.T) {
+	requests := []struct {
+		name, method, path, body string
+	}{
+		{"test", http.MethodGet, "/test", ""},
+		{"list people", http.MethodGet, "/people", ""},
+		{"get person", http.MethodGet, "/people/" + uuid.NewString(), ""},
+		{"create person", http.MethodPost, "/people", `{"Name":"Al"}`},
+		{"update person", http.MethodPut, "/people/" + uuid.NewString(), `{"Name":"Al"}`},
+		{"delete person", http.MethodDelete, "/people/" + uuid.NewString(), ""},
+	}
+	for _, request := range requests {
+		t.Run(request.name, func(t *testing.T) {
+			people := newFakePeople("Sam")
+			people.fail(errors.New("connection reset by peer"))
+			s, _ := newTestServer(t, people, nil)
+
+			recorder := serve(s, httptest.NewRequest(request.method, request.path, strings.NewReader(request.body)))
+			if recorder.Code != http.StatusInternalServerError {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, http.StatusInternalServerError, recorder.Body)
+			}
+			// the details of the failure stay in the logs
+			if strings.Contains(recorder.Body.String(), "connection reset") {
+				t.Errorf("body = %s, want the error hidden from the client", recorder.Body)
+			}
+		})
+	}
+}
+
+func TestExportPeople(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople("Sam", "Alex, Jr."), nil)
+
+	recorder := serve(s, httptest.NewRequest(http.MethodGet, "/export.csv", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if got := recorder.Header().Get("Content-Disposition"); got != `attachment; filename="people.csv"` {
+		t.Errorf("Content-Disposition = %q, want the people.csv attachment", got)
+	}
+	records, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("the export isn't csv: %v", err)
+	}
+	if len(records) != 3 || strings.Join(records[0], ",") != "name,id,created_at" || records[2][0] != "Alex, Jr." {
+		t.Errorf("records = %v, want the header and both people", records)
+	}
+}
+
+func TestExportPeopleStopsQueryingWhenCancelled(t *testing.T) {
+	const total = 1000
+	people := newFakePeople(manyPeople(total)...)
+	people.rowDelay = time.Millisecond
+	s, logs := newTestServer(t, people, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	recorder := serve(s, httptest.NewRequest(http.MethodGet, "/export.csv", nil).WithContext(ctx))
+
+	// no more rows are read once the export has returned
+	read := people.read.Load()
+	if read == 0 || read >= total {
+		t.Errorf("read %d rows, want the export to stop partway through the %d", read, total)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if people.read.Load() != read {
+		t.Errorf("rows were still read after the export stopped")
+	}
+	if trailer := recorder.Result().Trailer; trailer.Get(streamErrorTrailerKey) != context.Canceled.Error() {
+		t.Errorf("stream error trailer = %q, want %q", trailer.Get(streamErrorTrailerKey), context.Canceled)
+	}
+	if records := logs.withMessage(t, "The get context was canceled"); len(records) != 1 {
+		t.Errorf("logged the cancelled export %d times, want once", len(records))
+	}
+}
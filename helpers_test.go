@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// logBuffer Holds the logs of a test server. The requests log at the same time so it is guarded by the mutex.
+type logBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+// Write Adds a log line to the buffer.
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+// String Returns all the logs written so far.
+func (b *logBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// records Returns the json log records written so far.
+func (b *logBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	scanner := bufio.NewScanner(strings.NewReader(b.String()))
+	for scanner.Scan() {
+		var record map[string]any
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			t.Fatalf("log line %q is not json: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// withMessage Returns the log records with the message.
+func (b *logBuffer) withMessage(t *testing.T, message string) []map[string]any {
+	t.Helper()
+	var found []map[string]any
+	for _, record := range b.records(t) {
+		if record["msg"] == message {
+			found = append(found, record)
+		}
+	}
+	return found
+}
+
+// newTestServer Creates a server using the fake people rather than a database, without the pause so the tests run
+// quickly and with its debug logs written to the returned buffer. The configure function, when given, changes the
+// settings before the server is created.
+func newTestServer(t *testing.T, people PeopleRepository, configure func(*Config)) (*Server, *logBuffer) {
+	t.Helper()
+	config := defaultConfig()
+	config.PauseDuration = 0
+	config.LogLevel = slog.LevelDebug
+	if configure != nil {
+		configure(&config)
+	}
+
+	logs := &logBuffer{}
+	s := NewServer(nil, newRestClient(config.RestMaxRedirects, nil), newLogger(logs, config.LogLevel), config)
+	if people != nil {
+		s.people = people
+	}
+	t.Cleanup(func() {
+		// the workers are only started by the tests using them, stopping them otherwise does nothing
+		s.stopWorkers()
+		s.background.Wait()
+	})
+	return s, logs
+}
+
+// startTestServer Serves the routes of the server, the rest call is made to this server so test, parallel and aggregate
+// make their call to the server side get over the network like they do when running.
+func startTestServer(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+	testServer := httptest.NewServer(s.newRouter(false))
+	s.config.ServerSideBaseURL = testServer.URL
+	t.Cleanup(testServer.Close)
+	return testServer
+}
+
+// serve Handles the request with the routes of the server without going over the network, so the request can be given
+// a context of the test's choosing, like one that has already been cancelled.
+func serve(s *Server, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	s.newRouter(false).ServeHTTP(recorder, request)
+	return recorder
+}
+
+// cancelledContext Returns a context that has already been cancelled, like the context of a request whose client has
+// gone away.
+func cancelledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+// expiredContext Returns a context whose deadline has already passed, like the context of a request that ran out of
+// time. Cancelling it afterwards doesn't change why it is done.
+func expiredContext() context.Context {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	cancel()
+	return ctx
+}
+
+// fakePeople A PeopleRepository holding the people in memory. Each call takes the delay unless the context is done
+// first, when it returns the context error like pgx does, and returns err when it is set. Each row of List and Stream
+// takes the row delay, so a test can be done with the context partway through them. The people and err are
+// guarded by the mutex, a test changing them while the server is running uses fail.
+type fakePeople struct {
+	mutex  sync.Mutex
+	people []Person
+	// audits The events recorded by InsertAudit, in the order they were written.
+	audits []fakeAudit
+	err    error
+	delay  time.Duration
+	// rowDelay How long each row of List and Stream takes to read.
+	rowDelay time.Duration
+	// calls How many calls have been made.
+	calls atomic.Int32
+	// read How many people have been read from the rows of List and Stream.
+	read atomic.Int32
+}
+
+// fakeAudit An audit record written to the fake repository.
+type fakeAudit struct {
+	requestID, event string
+}
+
+// newFakePeople Creates a fake repository holding the people with the names.
+func newFakePeople(names ...string) *fakePeople {
+	f := &fakePeople{}
+	for i, name := range names {
+		f.people = append(f.people, Person{Name: name, ID: uuid.New(), CreatedAt: time.Unix(int64(i), 0).UTC()})
+	}
+	return f
+}
+
+// call Counts the call and waits for the delay, returning why the call failed if it did.
+func (f *fakePeople) call(ctx context.Context) error {
+	f.calls.Add(1)
+	if f.delay > 0 {
+		err := pause(ctx, f.delay)
+		if err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.err
+}
+
+// fail Has every call from now on return the error, or succeed again when it is nil.
+func (f *fakePeople) fail(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.err = err
+}
+
+// taken Returns the unique violation the database responds with when the name is already taken by someone other than
+// the person with the id. It must be called with the mutex held.
+func (f *fakePeople) taken(name string, id uuid.UUID) error {
+	for _, person := range f.people {
+		if person.Name == name && person.ID != id {
+			return &pgconn.PgError{Code: uniqueViolationCode, Message: "duplicate key value violates unique constraint"}
+		}
+	}
+	return nil
+}
+
+// snapshot Returns a copy of the people so they can be read while others are changed.
+func (f *fakePeople) snapshot() []Person {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]Person{}, f.people...)
+}
+
+func (f *fakePeople) First(ctx context.Context) (Person, error) {
+	err := f.call(ctx)
+	if err != nil {
+		return Person{}, err
+	}
+	people := f.snapshot()
+	if len(people) == 0 {
+		return Person{}, pgx.ErrNoRows
+	}
+	return people[0], nil
+}
+
+func (f *fakePeople) All(ctx context.Context) ([]Person, error) {
+	err := f.call(ctx)
+	if err != nil {
+		return []Person{}, err
+	}
+	return f.snapshot(), nil
+}
+
+func (f *fakePeople) List(ctx context.Context, limit, offset int) (PersonRows, error) {
+	err := f.call(ctx)
+	if err != nil {
+		return nil, err
+	}
+	people := f.snapshot()
+	people = people[min(offset, len(people)):]
+	people = people[:min(limit, len(people))]
+	return &fakeRows{ctx: ctx, people: people, delay: f.rowDelay, read: &f.read}, nil
+}
+
+func (f *fakePeople) Stream(ctx context.Context) (PersonRows, error) {
+	err := f.call(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{ctx: ctx, people: f.snapshot(), delay: f.rowDelay, read: &f.read}, nil
+}
+
+func (f *fakePeople) Get(ctx context.Context, id uuid.UUID) (Person, error) {
+	err := f.call(ctx)
+	if err != nil {
+		return Person{}, err
+	}
+	for _, person := range f.snapshot() {
+		if person.ID == id {
+			return person, nil
+		}
+	}
+	return Person{}, pgx.ErrNoRows
+}
+
+func (f *fakePeople) Insert(ctx context.Context, name string) (Person, error) {
+	err := f.call(ctx)
+	if err != nil {
+		return Person{}, err
+	}
+	person := Person{Name: name, ID: uuid.New(), CreatedAt: time.Now().UTC()}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err = f.taken(name, person.ID)
+	if err != nil {
+		return Person{}, err
+	}
+	f.people = append(f.people, person)
+	return person, nil
+}
+
+func (f *fakePeople) InsertAll(ctx context.Context, people []Person) (int64, error) {
+	err := f.call(ctx)
+	if err != nil {
+		return 0, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	// like the batch none of the people are kept when one of them can't be
+	added := append([]Person{}, f.people...)
+	for _, person := range people {
+		for _, other := range added {
+			if other.Name == person.Name {
+				return 0, &pgconn.PgError{Code: uniqueViolationCode, Message: "duplicate key value violates unique constraint"}
+			}
+		}
+		added = append(added, Person{Name: person.Name, ID: uuid.New(), CreatedAt: time.Now().UTC()})
+	}
+	f.people = added
+	return int64(len(people)), nil
+}
+
+func (f *fakePeople) Update(ctx context.Context, id uuid.UUID, name string) (Person, error) {
+	err := f.call(ctx)
+	if err != nil {
+		return Person{}, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err = f.taken(name, id)
+	if err != nil {
+		return Person{}, err
+	}
+	for i := range f.people {
+		if f.people[i].ID == id {
+			f.people[i].Name = name
+			return f.people[i], nil
+		}
+	}
+	return Person{}, pgx.ErrNoRows
+}
+
+func (f *fakePeople) Delete(ctx context.Context, id uuid.UUID) error {
+	err := f.call(ctx)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for i := range f.people {
+		if f.people[i].ID == id {
+			f.people = append(f.people[:i], f.people[i+1:]...)
+			return nil
+		}
+	}
+	return pgx.ErrNoRows
+}
+
+func (f *fakePeople) InsertAudit(ctx context.Context, requestID, event string) error {
+	err := f.call(ctx)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.audits = append(f.audits, fakeAudit{requestID: requestID, event: event})
+	return nil
+}
+
+func (f *fakePeople) Ping(ctx context.Context) error {
+	return f.call(ctx)
+}
+
+// audited Returns a copy of the audit records written so far.
+func (f *fakePeople) audited() []fakeAudit {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]fakeAudit{}, f.audits...)
+}
+
+// fakeRows The rows of the fake repository. Like the rows of pgx they stop once the context is done, with the context
+// error reported by Err.
+type fakeRows struct {
+	ctx    context.Context
+	people []Person
+	next   int
+	delay  time.Duration
+	read   *atomic.Int32
+	err    error
+}
+
+func (r *fakeRows) Next() bool {
+	if r.err != nil || r.next >= len(r.people) {
+		return false
+	}
+	if r.delay > 0 {
+		if r.err = pause(r.ctx, r.delay); r.err != nil {
+			return false
+		}
+	}
+	if r.err = r.ctx.Err(); r.err != nil {
+		return false
+	}
+	r.next++
+	r.read.Add(1)
+	return true
+}
+
+func (r *fakeRows) Person() (Person, error) {
+	return r.people[r.next-1], nil
+}
+
+func (r *fakeRows) Err() error {
+	return r.err
+}
+
+func (r *fakeRows) Close() {}
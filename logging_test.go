@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestLogsAreWrittenToTheWriter(t *testing.T) {
+	s, logs := newTestServer(t, nil, nil)
+	ctx := WithRequestID(context.Background(), "abc")
+
+	s.logInfo(ctx, "Something happened")
+	s.logError(ctx, "Something failed", errors.New("boom"))
+
+	records := logs.records(t)
+	if len(records) != 2 {
+		t.Fatalf("logged %d records, want 2: %s", len(records), logs)
+	}
+	for i, want := range []struct{ level, msg string }{{"INFO", "Something happened"}, {"ERROR", "Something failed"}} {
+		if records[i]["level"] != want.level || records[i]["msg"] != want.msg || records[i]["request_id"] != "abc" {
+			t.Errorf("record %d = %v, want %s %q with request id abc", i, records[i], want.level, want.msg)
+		}
+	}
+	if records[1]["error"] != "boom" {
+		t.Errorf("error = %v, want boom", records[1]["error"])
+	}
+}
+
+func TestLogDoneLogsTheReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{context.Canceled, "The get context was canceled"},
+		{context.DeadlineExceeded, "The get context has timed out"},
+		{errors.New("boom"), "The get context had an unexpected error"},
+	}
+	for _, test := range tests {
+		t.Run(test.err.Error(), func(t *testing.T) {
+			s, logs := newTestServer(t, nil, nil)
+			s.logDone(context.Background(), test.err)
+			if records := logs.withMessage(t, test.want); len(records) != 1 {
+				t.Errorf("logged %q %d times, want once: %s", test.want, len(records), logs)
+			}
+		})
+	}
+}
+
+func TestDebugLogsAreDroppedAtTheInfoLevel(t *testing.T) {
+	s, logs := newTestServer(t, nil, func(config *Config) {
+		config.LogLevel = slog.LevelInfo
+	})
+
+	s.logDebug(context.Background(), "Some detail")
+	s.logInfo(context.Background(), "Something happened")
+
+	if records := logs.withMessage(t, "Some detail"); len(records) != 0 {
+		t.Errorf("logged the debug record at the info level: %v", records)
+	}
+	if records := logs.withMessage(t, "Something happened"); len(records) != 1 {
+		t.Errorf("logged the info record %d times, want once", len(records))
+	}
+}
+
+func TestLoadConfigLogLevel(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "warn")
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.LogLevel != slog.LevelWarn {
+		t.Errorf("LogLevel = %s, want %s", config.LogLevel, slog.LevelWarn)
+	}
+
+	t.Setenv("LOG_LEVEL", "loud")
+	_, err = LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "LOG_LEVEL") {
+		t.Errorf("LoadConfig() error = %v, want the invalid LOG_LEVEL reported", err)
+	}
+}
+
+func TestLogSamplingIsDeterminedByTheRequestID(t *testing.T) {
+	sampled := 0
+	const requests = 1000
+	for i := 0; i < requests; i++ {
+		requestID := uuid.NewString()
+		first := isLogSampled(requestID, 0.5)
+		// every hop of a request makes the same decision as it has the same request id
+		for j := 0; j < 3; j++ {
+			if isLogSampled(requestID, 0.5) != first {
+				t.Fatalf("the sampling decision for %s changed", requestID)
+			}
+		}
+		if first {
+			sampled++
+		}
+		if isLogSampled(requestID, 0) || !isLogSampled(requestID, 1) {
+			t.Fatalf("%s was sampled at a rate of 0 or not at a rate of 1", requestID)
+		}
+	}
+	// roughly half are sampled, the bounds are wide enough to never fail by chance
+	if sampled < requests*2/5 || sampled > requests*3/5 {
+		t.Errorf("sampled %d of %d requests at a rate of 0.5", sampled, requests)
+	}
+}
+
+func TestSampledRequestsLogAtTheDebugLevel(t *testing.T) {
+	s, logs := newTestServer(t, nil, func(config *Config) {
+		config.LogLevel = slog.LevelInfo
+	})
+
+	s.logDebug(WithLogSampled(context.Background(), true), "Sampled detail")
+	s.logDebug(WithLogSampled(context.Background(), false), "Unsampled detail")
+	s.logWarn(WithLogSampled(context.Background(), false), "Unsampled warning")
+
+	for message, want := range map[string]int{"Sampled detail": 1, "Unsampled detail": 0, "Unsampled warning": 1} {
+		if got := len(logs.withMessage(t, message)); got != want {
+			t.Errorf("logged %q %d times, want %d", message, got, want)
+		}
+	}
+}
+
+func TestCombinedLogLine(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/people?limit=2", nil)
+	request.RemoteAddr = "192.0.2.1:54321"
+	request.Header.Set("User-Agent", `curl/8.0 "quoted"`)
+	request = request.WithContext(WithUserID(WithRequestID(request.Context(), "abc"), "paul"))
+	start := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+
+	got := combinedLogLine(request, http.StatusOK, 154, start)
+	want := `192.0.2.1 - paul [02/Jan/2006:15:04:05 +0000] "GET /people?limit=2 HTTP/1.1" 200 154 "-" "curl/8.0 \"quoted\"" "abc"`
+	if got != want {
+		t.Errorf("line = %s\nwant   %s", got, want)
+	}
+
+	// nothing written is shown as a dash rather than 0
+	request = httptest.NewRequest(http.MethodGet, "/test", nil)
+	if got := combinedLogLine(request, http.StatusNoContent, 0, start); !strings.Contains(got, `" 204 - "`) {
+		t.Errorf("line = %s, want a dash for the size", got)
+	}
+}
+
+func TestCombinedAccessLogIsWrittenForEachRequest(t *testing.T) {
+	s, logs := newTestServer(t, newFakePeople("Sam"), nil)
+	accessLog := &logBuffer{}
+	s.accessLog = accessLog
+
+	request := httptest.NewRequest(http.MethodGet, "/people", nil)
+	request.Header.Set(requestIDHeaderKey, "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f")
+	request.Header.Set("User-Agent", "curl/8.0")
+	request.Header.Set("Referer", "http://example.com/")
+	response := serve(s, request)
+
+	layout := regexp.MustCompile(`^192\.0\.2\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /people HTTP/1\.1" 200 (\d+) "http://example\.com/" "curl/8\.0" "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"\n$`)
+	match := layout.FindStringSubmatch(accessLog.String())
+	if match == nil {
+		t.Fatalf("access log = %q, want a combined log line", accessLog)
+	}
+	if size := strconv.Itoa(response.Body.Len()); match[1] != size {
+		t.Errorf("size = %s, want the %s bytes written", match[1], size)
+	}
+	// the access log takes the place of the json log of the finished request
+	if records := logs.withMessage(t, "Request finished"); len(records) != 0 {
+		t.Errorf("logged %d finished requests as json, want none", len(records))
+	}
+}
+
+func TestRequestFinishedLogHasTheAddedFields(t *testing.T) {
+	s, logs := newTestServer(t, newFakePeople("Sam", "Alex", "Jo"), nil)
+	startTestServer(t, s)
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	response := serve(s, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", response.Code, http.StatusOK, response.Body)
+	}
+
+	// the rest call's own request to the server side get is logged as finished too, without the fields of test
+	var finished map[string]any
+	for _, record := range logs.withMessage(t, "Request finished") {
+		if record["path"] == "/test" {
+			finished = record
+		}
+	}
+	if finished == nil {
+		t.Fatalf("test wasn't logged as finished: %s", logs)
+	}
+	// the numbers are decoded from the json log line as float64
+	if finished["db_rows"] != float64(3) || finished["rest_attempts"] != float64(1) {
+		t.Errorf("finished record = %v, want db_rows 3 and rest_attempts 1", finished)
+	}
+}
@@ -0,0 +1,63 @@
+//go:build metrics
+
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// requestsTotal Counts the requests handled by route and status, a 499 or 504 status shows a context that was done
+// before the request could finish.
+var requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_requests_total",
+	Help: "The number of requests handled by route and status.",
+}, []string{"route", "status"})
+
+// requestDuration Measures how long requests take by route. The buckets go past the ten seconds a request to test
+// takes with the default pause.
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "http_request_duration_seconds",
+	Help:    "How long requests took to handle by route.",
+	Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 7.5, 10, 15},
+}, []string{"route"})
+
+// contextDoneTotal Counts the contexts found to be done by the reason, showing how often clients give up on their
+// requests compared to requests that run out of time.
+var contextDoneTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "context_done_total",
+	Help: "The number of request contexts found to be done by reason.",
+}, []string{"reason"})
+
+// clientDisconnectsTotal Counts the requests to test whose client disconnected by the stage of the work they gave up
+// in.
+var clientDisconnectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "client_disconnects_total",
+	Help: "The number of clients that disconnected from test by the stage of the work, db or rest.",
+}, []string{"stage"})
+
+// registerMetrics Adds the endpoint, http://localhost:8080/metrics, exposing the metrics to Prometheus.
+func registerMetrics(router *mux.Router) {
+	router.Handle("/metrics", promhttp.Handler())
+}
+
+// recordRequest Adds a finished request to the metrics.
+func recordRequest(route string, status int, duration time.Duration) {
+	requestsTotal.WithLabelValues(route, strconv.Itoa(status)).Inc()
+	requestDuration.WithLabelValues(route).Observe(duration.Seconds())
+}
+
+// recordContextDone Adds a context that was found to be done for the reason to the metrics.
+func recordContextDone(reason string) {
+	contextDoneTotal.WithLabelValues(reason).Inc()
+}
+
+// recordClientDisconnect Adds a client that disconnected during the stage to the metrics.
+func recordClientDisconnect(stage string) {
+	clientDisconnectsTotal.WithLabelValues(stage).Inc()
+}
@@ -0,0 +1,48 @@
+//go:build metrics
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetric Returns the value of the metric, like context_done_total{reason="canceled"}, from the metrics endpoint.
+// A metric that hasn't been recorded yet is zero.
+func scrapeMetric(t *testing.T, s *Server, metric string) float64 {
+	t.Helper()
+	response := serve(s, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), metric+" ")
+		if !found {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("metric %s has the value %q: %v", metric, value, err)
+		}
+		return parsed
+	}
+	return 0
+}
+
+func TestCancelledRequestsAreCounted(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople(), nil)
+	const metric = `context_done_total{reason="canceled"}`
+	before := scrapeMetric(t, s, metric)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	serve(s, httptest.NewRequest(http.MethodGet, "/slow?delay=5s", nil).WithContext(ctx))
+
+	if after := scrapeMetric(t, s, metric); after != before+1 {
+		t.Errorf("%s = %v, want %v", metric, after, before+1)
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimitQueuesOverlappingRequests(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople(), func(config *Config) {
+		config.MaxConcurrentRequests = 1
+	})
+	testServer := startTestServer(t, s)
+
+	const delay = 200 * time.Millisecond
+	start := time.Now()
+	var wg sync.WaitGroup
+	statuses := make([]int, 2)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response, err := http.Get(testServer.URL + "/slow?delay=" + delay.String())
+			if err != nil {
+				t.Errorf("request %d failed: %v", i, err)
+				return
+			}
+			response.Body.Close()
+			statuses[i] = response.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	for i, status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("request %d status = %d, want %d", i, status, http.StatusOK)
+		}
+	}
+	// with a single slot the second request only starts once the first has finished
+	if elapsed := time.Since(start); elapsed < 2*delay {
+		t.Errorf("both requests finished after %s, want at least %s as they take turns", elapsed, 2*delay)
+	}
+}
+
+func TestConcurrencyLimitTurnsAwayRequestsThatRunOutOfTime(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople(), func(config *Config) {
+		config.MaxConcurrentRequests = 1
+	})
+	testServer := startTestServer(t, s)
+
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		close(started)
+		response, err := http.Get(testServer.URL + "/slow?delay=500ms")
+		if err == nil {
+			response.Body.Close()
+		}
+	}()
+	<-started
+	// give the first request time to take the only slot
+	time.Sleep(100 * time.Millisecond)
+
+	request, _ := http.NewRequest(http.MethodGet, testServer.URL+"/slow?delay=0s", nil)
+	request.Header.Set(requestTimeoutHeaderKey, "100ms")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", response.StatusCode, http.StatusServiceUnavailable)
+	}
+	<-done
+}
+
+func TestConcurrencyLimitLeavesOutTheInternalHop(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople("Sam"), func(config *Config) {
+		config.MaxConcurrentRequests = 1
+		config.PauseDuration = 50 * time.Millisecond
+	})
+	testServer := startTestServer(t, s)
+
+	// test holds the only slot while its rest call is handled, which would wait for that slot if it was limited
+	request, _ := http.NewRequest(http.MethodGet, testServer.URL+"/test", nil)
+	request.Header.Set(requestTimeoutHeaderKey, "2s")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", response.StatusCode, http.StatusOK)
+	}
+}
+
+func TestDeadlineRemainingHeader(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople(), nil)
+	testServer := startTestServer(t, s)
+
+	tests := []struct {
+		name    string
+		path    string
+		timeout string
+		// the header has to be a little under the budget as some of it is used before the response is written
+		budget time.Duration
+	}{
+		{"default budget", "/slow?delay=0s", "", defaultRequestTimeout},
+		{"client budget", "/slow?delay=0s", "2s", 2 * time.Second},
+		{"tighter route budget", "/server-side-get", "", serverSideGetTimeout},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodGet, testServer.URL+test.path, nil)
+			// the server side get only accepts requests carrying a request id like the rest call sends
+			request.Header.Set(requestIDHeaderKey, "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f")
+			if test.timeout != "" {
+				request.Header.Set(requestTimeoutHeaderKey, test.timeout)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			remaining, err := time.ParseDuration(response.Header.Get(deadlineRemainingHeaderKey))
+			if err != nil {
+				t.Fatalf("%s header %q is not a duration: %v", deadlineRemainingHeaderKey,
+					response.Header.Get(deadlineRemainingHeaderKey), err)
+			}
+			if remaining > test.budget || remaining < test.budget-time.Second {
+				t.Errorf("%s = %s, want just under %s", deadlineRemainingHeaderKey, remaining, test.budget)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		// keys The api key sent by each request, the last request is the one checked
+		keys   []string
+		known  []string
+		status int
+	}{
+		{"allowed within the burst", []string{""}, nil, http.StatusOK},
+		{"throttled", []string{"", ""}, nil, http.StatusTooManyRequests},
+		{"made up keys share the ip limit", []string{"a", "b"}, nil, http.StatusTooManyRequests},
+		{"known key has its own limit", []string{"", "secret"}, []string{"secret"}, http.StatusOK},
+		{"known key is limited", []string{"secret", "secret"}, []string{"secret"}, http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// a single request at once and then one every ten seconds, so the second is over the limit
+			s, _ := newTestServer(t, newFakePeople(), func(config *Config) {
+				config.RateLimit = 0.1
+				config.RateLimitBurst = 1
+				config.APIKeys = test.known
+			})
+			testServer := startTestServer(t, s)
+
+			var response *http.Response
+			for _, key := range test.keys {
+				header := http.Header{requestTimeoutHeaderKey: {"100ms"}}
+				if key != "" {
+					header.Set(apiKeyHeaderKey, key)
+				}
+				response, _ = do(t, http.MethodGet, testServer.URL+"/slow?delay=0s", "", header)
+			}
+			if response.StatusCode != test.status {
+				t.Errorf("status = %d, want %d", response.StatusCode, test.status)
+			}
+		})
+	}
+}
+
+func TestRateLimitGivesUpWhenTheClientGoesAway(t *testing.T) {
+	// a request every half second, so the second waits for its turn
+	s, _ := newTestServer(t, newFakePeople(), func(config *Config) {
+		config.RateLimit = 2
+		config.RateLimitBurst = 1
+	})
+	router := s.newRouter(false)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow?delay=0s", nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	recorder := httptest.NewRecorder()
+	start := time.Now()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/slow?delay=0s", nil).WithContext(ctx))
+
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusTooManyRequests)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("the request waited %s, want it to stop waiting when it was cancelled", elapsed)
+	}
+}
+
+func TestRateLimitLeavesOutTheInternalHop(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople("Sam"), func(config *Config) {
+		config.RateLimit = 0.1
+		config.RateLimitBurst = 1
+	})
+	testServer := startTestServer(t, s)
+
+	// the rest call comes from the same address as the request to test, which has used up the burst
+	response, body := do(t, http.MethodGet, testServer.URL+"/test", "", http.Header{requestTimeoutHeaderKey: {"2s"}})
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d: %s", response.StatusCode, http.StatusOK, body)
+	}
+}
+
+func TestHeaderMiddlewareFindsTheRequestIDWhateverItsCasing(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople(), nil)
+	const requestID = "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"
+
+	for _, name := range []string{"Request-Id", "request-id", "REQUEST-ID", "rEqUeSt-iD"} {
+		t.Run(name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/slow?delay=0s", nil)
+			// set on the map directly so the name isn't made canonical like Header.Set would
+			request.Header[name] = []string{requestID}
+			response := serve(s, request)
+			if got := response.Header().Get(requestIDHeaderKey); got != requestID {
+				t.Errorf("request id = %q, want %q", got, requestID)
+			}
+		})
+	}
+}
+
+func TestHeaderMiddlewareRemovesHopByHopHeaders(t *testing.T) {
+	var received http.Header
+	handler := headerMiddleware(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		received = request.Header.Clone()
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Connection", "X-Secret, keep-alive")
+	request.Header.Set("X-Secret", "hidden")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Accept", "application/json")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	for _, name := range []string{"Connection", "X-Secret", "Upgrade"} {
+		if received.Get(name) != "" {
+			t.Errorf("%s header = %q, want it removed", name, received.Get(name))
+		}
+	}
+	if received.Get("Accept") != "application/json" {
+		t.Errorf("Accept header = %q, want it kept", received.Get("Accept"))
+	}
+}
+
+func TestSuspiciousHeadersAreLoggedWithTheRequestID(t *testing.T) {
+	s, logs := newTestServer(t, newFakePeople(), nil)
+	const requestID = "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"
+
+	request := httptest.NewRequest(http.MethodGet, "/slow?delay=0s", nil)
+	request.Header["request-id"] = []string{requestID, "4bf92f35-77b3-4da6-a3ce-929d0e0e4736"}
+	request.Header.Set("X_Forwarded_For", "10.0.0.1")
+	request.Header.Set("X-Long", strings.Repeat("a", maxHeaderValueLength+1))
+	response := serve(s, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", response.Code, http.StatusOK)
+	}
+
+	var warnings int
+	for _, record := range logs.records(t) {
+		if record["level"] != "WARN" {
+			continue
+		}
+		warnings++
+		if record["request_id"] != requestID {
+			t.Errorf("warning %q has request id %v, want %q", record["msg"], record["request_id"], requestID)
+		}
+	}
+	if warnings != 3 {
+		t.Errorf("logged %d warnings, want 3: %s", warnings, logs)
+	}
+}
+
+func TestWithTimeoutStopsASlowHandler(t *testing.T) {
+	const budget = 100 * time.Millisecond
+	var handlerErr error
+	handler := withTimeout(budget)(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		handlerErr = pause(request.Context(), 5*time.Second)
+	}))
+
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if elapsed := time.Since(start); elapsed > budget+time.Second {
+		t.Errorf("the handler returned after %s, want about %s", elapsed, budget)
+	}
+	if !errors.Is(handlerErr, context.DeadlineExceeded) {
+		t.Errorf("handler error = %v, want %v", handlerErr, context.DeadlineExceeded)
+	}
+}
+
+func TestSlowRespondsOnceTheDeadlinePasses(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople(), nil)
+
+	request := httptest.NewRequest(http.MethodGet, "/slow?delay=5s", nil)
+	request.Header.Set(requestTimeoutHeaderKey, "100ms")
+	start := time.Now()
+	response := serve(s, request)
+	if response.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d", response.Code, http.StatusGatewayTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("slow responded after %s, want it to stop at the 100ms deadline", elapsed)
+	}
+}
+
+func TestRecoverRespondsToAPanicWithAServerError(t *testing.T) {
+	s, logs := newTestServer(t, nil, nil)
+	router := s.newRouter(false)
+	// the middleware of the router wrap the routes added after it was built as well
+	router.HandleFunc("/panic", func(http.ResponseWriter, *http.Request) {
+		panic("something went wrong")
+	})
+	testServer := httptest.NewServer(router)
+	defer testServer.Close()
+
+	response, body := do(t, http.MethodGet, testServer.URL+"/panic", "", nil)
+	if response.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", response.StatusCode, http.StatusInternalServerError)
+	}
+	if !strings.Contains(body, "an internal error occurred") {
+		t.Errorf("body = %s, want the internal error response", body)
+	}
+	if records := logs.withMessage(t, "Recovered from a panic"); len(records) != 1 {
+		t.Errorf("logged the panic %d times, want once", len(records))
+	}
+
+	// the server is still running after the panic
+	response, _ = do(t, http.MethodGet, testServer.URL+"/slow?delay=0s", "", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("status after the panic = %d, want %d", response.StatusCode, http.StatusOK)
+	}
+}
+
+func TestBodyLimitRejectsAnOversizedBody(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople(), func(config *Config) {
+		config.MaxBodyBytes = 64
+	})
+	body := `{"Name":"` + strings.Repeat("a", 100) + `"}`
+
+	for _, test := range []struct {
+		name          string
+		contentLength int64
+	}{
+		{"declared", int64(len(body))},
+		// without a declared length the body is only found to be too large as the handler reads it
+		{"streamed", -1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/people", strings.NewReader(body))
+			request.ContentLength = test.contentLength
+			response := serve(s, request)
+			if response.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("status = %d, want %d", response.Code, http.StatusRequestEntityTooLarge)
+			}
+		})
+	}
+}
+
+func TestRequestIDIsGeneratedWhenMissing(t *testing.T) {
+	s, logs := newTestServer(t, newFakePeople(), nil)
+	const generated = "11111111-2222-3333-4444-555555555555"
+	s.idGenerator = func() string { return generated }
+
+	for _, test := range []struct{ name, incoming string }{
+		{"missing", ""},
+		{"invalid", "not-a-uuid"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/slow?delay=0s", nil)
+			if test.incoming != "" {
+				request.Header.Set(requestIDHeaderKey, test.incoming)
+			}
+			response := serve(s, request)
+			if got := response.Header().Get(requestIDHeaderKey); got != generated {
+				t.Errorf("request id header = %q, want %q", got, generated)
+			}
+			records := logs.withMessage(t, "Slow was called")
+			if len(records) == 0 || records[len(records)-1]["request_id"] != generated {
+				t.Errorf("log records = %v, want the last with the request id %q", records, generated)
+			}
+		})
+	}
+}
+
+func TestServerErrorHasTheRequestIDAndServerHeaders(t *testing.T) {
+	people := newFakePeople("Sam")
+	people.fail(errors.New("the database broke"))
+	s, _ := newTestServer(t, people, nil)
+	const requestID = "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"
+
+	request := httptest.NewRequest(http.MethodGet, "/people", nil)
+	request.Header.Set(requestIDHeaderKey, requestID)
+	response := serve(s, request)
+
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", response.Code, http.StatusInternalServerError)
+	}
+	if got := response.Header().Get(requestIDHeaderKey); got != requestID {
+		t.Errorf("request id header = %q, want %q", got, requestID)
+	}
+	if got := response.Header().Get("Server"); got != serverName+"/"+version {
+		t.Errorf("server header = %q, want %q", got, serverName+"/"+version)
+	}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name        string
+		traceParent string
+		wantOK      bool
+	}{
+		{"valid", "00-" + traceID + "-00f067aa0ba902b7-01", true},
+		{"future version", "01-" + traceID + "-00f067aa0ba902b7-00", true},
+		{"empty", "", false},
+		{"missing flags", "00-" + traceID + "-00f067aa0ba902b7", false},
+		{"invalid version", "ff-" + traceID + "-00f067aa0ba902b7-01", false},
+		{"uppercase", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"short trace id", "00-4bf92f3577b34da6-00f067aa0ba902b7-01", false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"zero parent id", "00-" + traceID + "-0000000000000000-01", false},
+		{"not hex", "00-" + traceID + "-00f067aa0ba902bz-01", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := parseTraceParent(test.traceParent)
+			if ok != test.wantOK || (ok && got != traceID) {
+				t.Errorf("parseTraceParent(%q) = %q, %t, want %t", test.traceParent, got, ok, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestTraceIDPropagatesAcrossTheRestCall(t *testing.T) {
+	s, logs := newTestServer(t, newFakePeople("Sam"), nil)
+	testServer := startTestServer(t, s)
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	response, body := do(t, http.MethodGet, testServer.URL+"/test", "",
+		http.Header{traceParentHeaderKey: {"00-" + traceID + "-00f067aa0ba902b7-01"}})
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", response.StatusCode, http.StatusOK, body)
+	}
+	var requestIDs []any
+	for _, message := range []string{"Get was called", "Server side get was called"} {
+		records := logs.withMessage(t, message)
+		if len(records) != 1 || records[0]["trace_id"] != traceID {
+			t.Fatalf("%q records = %v, want one with the trace id %s", message, records, traceID)
+		}
+		requestIDs = append(requestIDs, records[0]["request_id"])
+	}
+	// the request id isn't per hop here, the rest call passes on the request id of test so both hops log the same one
+	if requestIDs[0] != requestIDs[1] {
+		t.Errorf("request ids = %v, want the request id of test on both hops", requestIDs)
+	}
+}
+
+func TestTraceIDIsCreatedWithoutATraceParent(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceParent string
+	}{
+		{"missing", ""},
+		{"malformed", "not a traceparent"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var traceID string
+			handler := traceMiddleware(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				traceID, _ = GetTraceID(request.Context())
+			}))
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.traceParent != "" {
+				request.Header.Set(traceParentHeaderKey, test.traceParent)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			if !isHex(traceID, 32) {
+				t.Errorf("trace id = %q, want 32 hex characters", traceID)
+			}
+		})
+	}
+}
+
+func TestInternalRouteRequiresARequestID(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople("Sam"), nil)
+	testServer := startTestServer(t, s)
+
+	// called directly, like curl without the header
+	response, body := do(t, http.MethodGet, testServer.URL+"/server-side-get", "", nil)
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d: %s", response.StatusCode, http.StatusBadRequest, body)
+	}
+
+	// called by the rest call, which always sends the request id of the request it is part of
+	person, err := s.restCall(WithRequestID(context.Background(), "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"))
+	if err != nil || person.Name != "Paul" {
+		t.Errorf("restCall() = %+v, %v, want Paul", person, err)
+	}
+}
+
+func TestPanicLogHasTheRequestID(t *testing.T) {
+	s, logs := newTestServer(t, nil, nil)
+	router := s.newRouter(false)
+	router.HandleFunc("/panic", func(http.ResponseWriter, *http.Request) {
+		panic("something went wrong")
+	})
+	const requestID = "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"
+
+	request := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	request.Header.Set(requestIDHeaderKey, requestID)
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	// the request id middleware runs before recover, so the panic is logged with the request id
+	records := logs.withMessage(t, "Recovered from a panic")
+	if len(records) != 1 || records[0]["request_id"] != requestID {
+		t.Errorf("panic records = %v, want one with the request id %s", records, requestID)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip, br", true},
+		{"gzip;q=0.5", true},
+		{"br, gzip; q=1.0", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"gzip;q=high", false},
+		{"deflate, br", false},
+		{"x-gzip", false},
+	}
+	for _, test := range tests {
+		if got := acceptsGzip(test.acceptEncoding); got != test.want {
+			t.Errorf("acceptsGzip(%q) = %t, want %t", test.acceptEncoding, got, test.want)
+		}
+	}
+}
+
+func TestGzipMiddlewareCompressesTheResponse(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople(manyPeople(100)...), nil)
+
+	request := httptest.NewRequest(http.MethodGet, "/people?limit=100", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	response := serve(s, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", response.Code, http.StatusOK)
+	}
+	if got := response.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := response.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+
+	reader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page struct {
+		People []Person
+	}
+	err = json.NewDecoder(reader).Decode(&page)
+	if err != nil {
+		t.Fatalf("the decompressed body isn't json: %v", err)
+	}
+	if len(page.People) != 100 {
+		t.Errorf("decompressed %d people, want 100", len(page.People))
+	}
+}
+
+func TestGzipMiddlewareLeavesTheResponseAloneWhenNotAccepted(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople("Sam"), nil)
+
+	request := httptest.NewRequest(http.MethodGet, "/people", nil)
+	request.Header.Set("Accept-Encoding", "gzip;q=0")
+	response := serve(s, request)
+	if got := response.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q, want none", got)
+	}
+	if !json.Valid(response.Body.Bytes()) {
+		t.Errorf("body = %q, want plain json", response.Body)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !metrics
+
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// registerMetrics Does nothing, build with the metrics tag to expose metrics at /metrics.
+func registerMetrics(router *mux.Router) {}
+
+// recordRequest Does nothing, build with the metrics tag to record requests.
+func recordRequest(route string, status int, duration time.Duration) {}
+
+// recordContextDone Does nothing, build with the metrics tag to record done contexts.
+func recordContextDone(reason string) {}
+
+// recordClientDisconnect Does nothing, build with the metrics tag to record client disconnects.
+func recordClientDisconnect(stage string) {}
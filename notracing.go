@@ -0,0 +1,29 @@
+//go:build !tracing
+
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// setupTracing Does nothing, build with the tracing tag to export spans over OTLP.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	return func(context.Context) error { return nil }, nil
+}
+
+// spanMiddleware Does nothing, build with the tracing tag to start a span for every request.
+func spanMiddleware(next http.Handler) http.Handler {
+	return next
+}
+
+// startSpan Does nothing, build with the tracing tag to start spans.
+func startSpan(ctx context.Context, name string) (context.Context, func(error)) {
+	return ctx, func(error) {}
+}
+
+// injectSpan Does nothing, build with the tracing tag to send the span along. The traceparent header is set from the
+// trace id alone instead.
+func injectSpan(ctx context.Context, request *http.Request) bool {
+	return false
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startUpstream Serves the handler in place of the server side get, the rest calls of the server are made to it.
+func startUpstream(t *testing.T, s *Server, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(handler)
+	s.config.ServerSideBaseURL = upstream.URL
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// respondWithPerson Responds to the rest call with a person named Sam.
+func respondWithPerson(response http.ResponseWriter, _ *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(response).Encode(Person{Name: "Sam"})
+}
+
+func TestRestCallWithoutARequestID(t *testing.T) {
+	s, _ := newTestServer(t, nil, nil)
+	received := make(chan http.Header, 1)
+	startUpstream(t, s, func(response http.ResponseWriter, request *http.Request) {
+		received <- request.Header.Clone()
+		respondWithPerson(response, request)
+	})
+
+	// a context that never went through the request id middleware
+	person, err := s.restCall(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if person.Name != "Sam" {
+		t.Errorf("name = %q, want %q", person.Name, "Sam")
+	}
+	if header := <-received; header.Get(requestIDHeaderKey) != "" {
+		t.Errorf("request id header = %q, want none", header.Get(requestIDHeaderKey))
+	}
+}
+
+func TestRestCallReturnsTheRequestConstructionError(t *testing.T) {
+	s, _ := newTestServer(t, nil, func(config *Config) {
+		// a space isn't allowed in a host so the request can't be created
+		config.ServerSideBaseURL = "http://server side"
+	})
+
+	_, err := s.restCall(context.Background())
+	if err == nil {
+		t.Fatal("the rest call succeeded, want the error creating its request")
+	}
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		t.Errorf("error = %v, want a *url.Error", err)
+	}
+}
+
+// roundTripFunc Lets a function stand in for the transport of a client, so a rest call never leaves the test.
+type roundTripFunc func(request *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+func TestRestCallUsesTheInjectedClient(t *testing.T) {
+	s, _ := newTestServer(t, nil, nil)
+	var calls int
+	s.client = &http.Client{Transport: roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		calls++
+		recorder := httptest.NewRecorder()
+		respondWithPerson(recorder, request)
+		return recorder.Result(), nil
+	})}
+
+	person, err := s.restCall(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if person.Name != "Sam" || calls != 1 {
+		t.Errorf("person = %+v after %d calls, want Sam after 1 call", person, calls)
+	}
+}
+
+func TestNewRestClientHasTransportTimeouts(t *testing.T) {
+	transport, ok := newRestClient(3, nil).Transport.(*http.Transport)
+	if !ok {
+		t.Fatal("the transport isn't an *http.Transport")
+	}
+	if transport.TLSHandshakeTimeout <= 0 || transport.ResponseHeaderTimeout <= 0 || transport.IdleConnTimeout <= 0 {
+		t.Errorf("transport timeouts = %s, %s, %s, want all of them set", transport.TLSHandshakeTimeout,
+			transport.ResponseHeaderTimeout, transport.IdleConnTimeout)
+	}
+}
+
+func TestRestCallCarriesTheRequestID(t *testing.T) {
+	s, _ := newTestServer(t, nil, nil)
+	received := make(chan string, 1)
+	startUpstream(t, s, func(response http.ResponseWriter, request *http.Request) {
+		received <- request.Header.Get(requestIDHeaderKey)
+		respondWithPerson(response, request)
+	})
+
+	const requestID = "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"
+	_, err := s.restCall(WithRequestID(context.Background(), requestID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != requestID {
+		t.Errorf("outbound request id = %q, want %q", got, requestID)
+	}
+}
+
+func TestRestCallAttemptReturnsTheUpstreamStatus(t *testing.T) {
+	tests := []struct {
+		status    int
+		wantRetry bool
+	}{
+		{http.StatusNotFound, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, true},
+		{http.StatusServiceUnavailable, true},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			s, _ := newTestServer(t, nil, nil)
+			startUpstream(t, s, func(response http.ResponseWriter, _ *http.Request) {
+				http.Error(response, "failed", test.status)
+			})
+
+			_, retry, err := s.restCallAttempt(context.Background())
+			var upstreamErr *UpstreamError
+			if !errors.As(err, &upstreamErr) {
+				t.Fatalf("error = %v, want an *UpstreamError", err)
+			}
+			if upstreamErr.StatusCode != test.status || upstreamErr.Body != "failed\n" {
+				t.Errorf("upstream error = %d %q, want %d %q", upstreamErr.StatusCode, upstreamErr.Body, test.status,
+					"failed\n")
+			}
+			if retry != test.wantRetry {
+				t.Errorf("retry = %t, want %t", retry, test.wantRetry)
+			}
+		})
+	}
+}
+
+func TestTestRespondsWithBadGatewayWhenTheServerSideGetFails(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople("Sam"), nil)
+	testServer := httptest.NewServer(s.newRouter(false))
+	defer testServer.Close()
+	startUpstream(t, s, func(response http.ResponseWriter, _ *http.Request) {
+		http.Error(response, "failed", http.StatusInternalServerError)
+	})
+
+	response, body := do(t, http.MethodGet, testServer.URL+"/test", "", nil)
+	if response.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d: %s", response.StatusCode, http.StatusBadGateway, body)
+	}
+}
+
+func TestRestCallFollowsRedirects(t *testing.T) {
+	const requestID = "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f"
+	tests := []struct {
+		name      string
+		redirects int
+		wantErr   bool
+	}{
+		{"within the limit", 3, false},
+		{"over the limit", 4, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestServer(t, nil, func(config *Config) {
+				config.RestMaxRedirects = 3
+			})
+			s.client = newRestClient(s.config.RestMaxRedirects, nil)
+			startUpstream(t, s, func(response http.ResponseWriter, request *http.Request) {
+				if got := request.Header.Get(requestIDHeaderKey); got != requestID {
+					t.Errorf("request id of %s = %q, want %q", request.URL, got, requestID)
+				}
+				hop, _ := strconv.Atoi(request.URL.Query().Get("hop"))
+				if hop < test.redirects {
+					http.Redirect(response, request, fmt.Sprintf("/server-side-get?hop=%d", hop+1), http.StatusFound)
+					return
+				}
+				respondWithPerson(response, request)
+			})
+
+			person, err := s.restCall(WithRequestID(context.Background(), requestID))
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "stopped after 3 redirects") {
+					t.Errorf("error = %v, want it to stop after 3 redirects", err)
+				}
+				return
+			}
+			if err != nil || person.Name != "Sam" {
+				t.Errorf("restCall() = %+v, %v, want Sam", person, err)
+			}
+		})
+	}
+}
+
+func TestRestCallRetriesWithinTheDeadline(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeout   time.Duration
+		wantCalls int32
+	}{
+		// there is time for all the attempts and the backoffs of 100ms and 200ms between them
+		{"generous deadline", 5 * time.Second, restCallAttempts},
+		// after the first backoff only 150ms is left, not enough for the second backoff of 200ms
+		{"tight deadline", 250 * time.Millisecond, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, logs := newTestServer(t, nil, nil)
+			var calls atomic.Int32
+			startUpstream(t, s, func(response http.ResponseWriter, _ *http.Request) {
+				calls.Add(1)
+				http.Error(response, "failed", http.StatusServiceUnavailable)
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+			_, err := s.restCall(ctx)
+			if !isUpstreamServerError(err) {
+				t.Errorf("error = %v, want the upstream error of the last attempt", err)
+			}
+			if got := calls.Load(); got != test.wantCalls {
+				t.Errorf("made %d attempts, want %d", got, test.wantCalls)
+			}
+			if ctx.Err() != nil {
+				t.Errorf("the retries ran until the deadline, want them to stop before it")
+			}
+			gaveUp := len(logs.withMessage(t, "Not enough time is left to retry the rest call")) == 1
+			if gaveUp != (test.wantCalls < restCallAttempts) {
+				t.Errorf("logged giving up %t, want %t", gaveUp, test.wantCalls < restCallAttempts)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	breaker := newCircuitBreaker(3, cooldown)
+
+	// closed: failures below the threshold let calls through
+	for i := 1; i <= 2; i++ {
+		if err := breaker.allow(); err != nil {
+			t.Fatalf("allow() = %v while closed", err)
+		}
+		if breaker.failure() {
+			t.Fatalf("failure %d opened the circuit, want it to take 3", i)
+		}
+	}
+
+	// open: the failure reaching the threshold opens it and calls fail fast
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("allow() = %v while closed", err)
+	}
+	if !breaker.failure() {
+		t.Fatal("the third failure didn't open the circuit")
+	}
+	if err := breaker.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("allow() = %v while open, want %v", err, errCircuitOpen)
+	}
+
+	// half open: after the cooldown a single trial call is let through
+	time.Sleep(cooldown)
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("allow() = %v after the cooldown, want the trial call let through", err)
+	}
+	if err := breaker.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("allow() = %v during the trial, want %v", err, errCircuitOpen)
+	}
+
+	// a failed trial opens it again for another cooldown
+	if !breaker.failure() {
+		t.Fatal("the failed trial didn't open the circuit")
+	}
+	if err := breaker.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("allow() = %v after the failed trial, want %v", err, errCircuitOpen)
+	}
+
+	// a trial that neither succeeds nor fails lets another call be the trial
+	time.Sleep(cooldown)
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("allow() = %v after the cooldown", err)
+	}
+	breaker.release()
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("allow() = %v after the trial was released", err)
+	}
+
+	// closed: a successful trial closes it and the failures start over
+	if !breaker.success() {
+		t.Fatal("the successful trial didn't report closing the circuit")
+	}
+	for i := 1; i <= 2; i++ {
+		if err := breaker.allow(); err != nil {
+			t.Fatalf("allow() = %v after closing", err)
+		}
+		if breaker.failure() {
+			t.Fatalf("failure %d after closing opened the circuit, want the count to start over", i)
+		}
+	}
+}
+
+func TestTestRespondsWithServiceUnavailableWhileTheCircuitIsOpen(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople("Sam"), nil)
+	var calls atomic.Int32
+	startUpstream(t, s, func(response http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		http.Error(response, "failed", http.StatusInternalServerError)
+	})
+	for i := 0; i < restCircuitThreshold; i++ {
+		s.breaker.failure()
+	}
+
+	recorder := serve(s, httptest.NewRequest(http.MethodGet, "/test", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	if calls.Load() != 0 {
+		t.Errorf("made %d rest calls, want none while the circuit is open", calls.Load())
+	}
+}
+
+func TestTestReturnsTheDatabasePeopleWhenTheRestCallTimesOut(t *testing.T) {
+	const restCallTimeout = 100 * time.Millisecond
+	s, _ := newTestServer(t, newFakePeople("Alex", "Jo"), func(config *Config) {
+		config.RestCallTimeout = restCallTimeout
+	})
+	startUpstream(t, s, func(response http.ResponseWriter, request *http.Request) {
+		// far slower than the rest call may take, but it stops once the rest call gives up
+		_ = pause(request.Context(), 5*time.Second)
+		respondWithPerson(response, request)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.Header.Set(requestTimeoutHeaderKey, "2s")
+	start := time.Now()
+	response := serve(s, request)
+	elapsed := time.Since(start)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", response.Code, http.StatusOK, response.Body)
+	}
+	if got := response.Header().Get("Warning"); got != partialWarning {
+		t.Errorf("Warning header = %q, want %q", got, partialWarning)
+	}
+	var people []Person
+	err := json.Unmarshal(response.Body.Bytes(), &people)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 2 || people[0].Name != "Alex" || people[1].Name != "Jo" {
+		t.Errorf("people = %v, want only the database people", people)
+	}
+	// the rest call's own timeout ended it, well within the budget of the request
+	if elapsed > time.Second {
+		t.Errorf("test took %s, want about the %s of the rest call", elapsed, restCallTimeout)
+	}
+}
+
+// deadlineTolerance How far apart the deadlines of the two hops, and the moments they give up, may be. The server side
+// get starts its budget when the rest call arrives rather than when it was sent, which on one machine is well under a
+// millisecond, and a timer fires a little after its deadline. The tolerance leaves room for a busy test machine, such
+// as when the tests are run with -race.
+const deadlineTolerance = 50 * time.Millisecond
+
+// contextObservation What the server side get's context looked like, its deadline and when and why it was done.
+type contextObservation struct {
+	deadline time.Time
+	done     time.Time
+	err      error
+}
+
+func TestDeadlinePropagatesAcrossTheInternalHop(t *testing.T) {
+	// the server side get pauses for far longer than the deadline, only the deadline it was passed stops it
+	serverSide, _ := newTestServer(t, nil, func(config *Config) {
+		config.PauseDuration = 5 * time.Second
+	})
+	serverSideRouter := serverSide.newRouter(true)
+	// middleware added last runs closest to the handler, after the request timeout header has set the deadline
+	observed := make(chan contextObservation, 1)
+	serverSideRouter.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			deadline, _ := request.Context().Deadline()
+			next.ServeHTTP(response, request)
+			observed <- contextObservation{deadline: deadline, done: time.Now(), err: request.Context().Err()}
+		})
+	})
+	serverSideTestServer := httptest.NewServer(serverSideRouter)
+	defer serverSideTestServer.Close()
+
+	s, _ := newTestServer(t, newFakePeople("Sam"), func(config *Config) {
+		config.ServerSideBaseURL = serverSideTestServer.URL
+	})
+	deadlines := make(chan time.Time, 1)
+	router := s.newRouter(false)
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			deadline, _ := request.Context().Deadline()
+			deadlines <- deadline
+			next.ServeHTTP(response, request)
+		})
+	})
+	testServer := httptest.NewServer(router)
+	defer testServer.Close()
+
+	response, body := do(t, http.MethodGet, testServer.URL+"/test", "", http.Header{requestTimeoutHeaderKey: {"1s"}})
+	if response.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d: %s", response.StatusCode, http.StatusGatewayTimeout, body)
+	}
+	deadline := <-deadlines
+
+	var serverSideGet contextObservation
+	select {
+	case serverSideGet = <-observed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the server side get is still running")
+	}
+	// without the deadline being passed on the server side get would have its own seven seconds
+	if gap := serverSideGet.deadline.Sub(deadline).Abs(); gap > deadlineTolerance {
+		t.Errorf("the deadline of the server side get is %s from the deadline of test, want within %s", gap,
+			deadlineTolerance)
+	}
+	if gap := serverSideGet.done.Sub(deadline).Abs(); gap > deadlineTolerance {
+		t.Errorf("the server side get stopped %s from the deadline of test, want within %s", gap, deadlineTolerance)
+	}
+	// the server side get usually runs out of its own time first. The rest call hanging up at its deadline cancels the
+	// server side get's context too, and now and then that is noticed a moment before its own deadline passes.
+	if !errors.Is(serverSideGet.err, context.DeadlineExceeded) && !errors.Is(serverSideGet.err, context.Canceled) {
+		t.Errorf("the server side get's context error = %v, want %v", serverSideGet.err, context.DeadlineExceeded)
+	}
+}
+
+func TestRestCallCarriesTheTimeLeft(t *testing.T) {
+	s, _ := newTestServer(t, nil, nil)
+	received := make(chan string, 1)
+	startUpstream(t, s, func(response http.ResponseWriter, request *http.Request) {
+		received <- request.Header.Get(requestTimeoutHeaderKey)
+		respondWithPerson(response, request)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := s.restCall(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout, err := time.ParseDuration(<-received)
+	if err != nil || timeout <= 0 || timeout > time.Second {
+		t.Errorf("request timeout = %s (%v), want what is left of the second", timeout, err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitForHandling Waits until the server is handling at least the number of requests.
+func waitForHandling(t *testing.T, s *Server, requests int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.handling.Load() < requests {
+		if time.Now().After(deadline) {
+			t.Fatalf("handling %d requests, want %d", s.handling.Load(), requests)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestShutdownRejectsNewRequests(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople("Sam"), nil)
+
+	response := serve(s, httptest.NewRequest(http.MethodGet, "/people", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("status before shutdown = %d, want %d", response.Code, http.StatusOK)
+	}
+
+	s.shuttingDown.Store(true)
+	response = serve(s, httptest.NewRequest(http.MethodGet, "/people", nil))
+	if response.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", response.Code, http.StatusServiceUnavailable)
+	}
+	if got := response.Header().Get("Connection"); got != "close" {
+		t.Errorf("Connection header = %q, want %q", got, "close")
+	}
+}
+
+func TestShutdownLetsTheInternalHopThrough(t *testing.T) {
+	s, _ := newTestServer(t, newFakePeople("Sam"), nil)
+	s.shuttingDown.Store(true)
+
+	request := httptest.NewRequest(http.MethodGet, "/server-side-get", nil)
+	request.Header.Set(requestIDHeaderKey, "0b9b8a3e-1f0e-4d8b-9f55-3a6f2c1d2e4f")
+	response := serve(s, request)
+	if response.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", response.Code, http.StatusOK)
+	}
+}
+
+func TestDrainLetsTheInFlightTestFinish(t *testing.T) {
+	s, logs := newTestServer(t, newFakePeople("Sam"), func(config *Config) {
+		config.PauseDuration = 200 * time.Millisecond
+	})
+	testServer := startTestServer(t, s)
+
+	status := make(chan int, 1)
+	go func() {
+		response, err := http.Get(testServer.URL + "/test")
+		if err != nil {
+			t.Errorf("request failed: %v", err)
+			status <- 0
+			return
+		}
+		response.Body.Close()
+		status <- response.StatusCode
+	}()
+	// shutdown begins while test pauses, before it makes its rest call back to the server
+	waitForHandling(t, s, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.drain(ctx, testServer.Config)
+
+	if got := <-status; got != http.StatusOK {
+		t.Errorf("status = %d, want %d", got, http.StatusOK)
+	}
+	if records := logs.withMessage(t, "Error waiting for requests to finish"); len(records) != 0 {
+		t.Errorf("drain gave up on the requests: %v", records)
+	}
+}
+
+func TestDrainGivesUpOnRequestsThatRunOver(t *testing.T) {
+	s, logs := newTestServer(t, newFakePeople(), nil)
+	testServer := startTestServer(t, s)
+
+	failed := make(chan error, 1)
+	go func() {
+		response, err := http.Get(testServer.URL + "/slow?delay=5s")
+		if err == nil {
+			response.Body.Close()
+		}
+		failed <- err
+	}()
+	waitForHandling(t, s, 1)
+
+	const drainTimeout = 100 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	start := time.Now()
+	s.drain(ctx, testServer.Config)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain took %s, want about %s", elapsed, drainTimeout)
+	}
+
+	// closing the connection cancels the request's context so it stops rather than running for the whole delay
+	if err := <-failed; err == nil {
+		t.Error("the request finished, want its connection to have been closed")
+	}
+	records := logs.withMessage(t, "Error waiting for requests to finish")
+	if len(records) != 1 {
+		t.Fatalf("logged %d drain errors, want 1", len(records))
+	}
+	if got := records[0]["in_flight"]; got != float64(1) {
+		t.Errorf("in_flight = %v, want 1", got)
+	}
+}
@@ -0,0 +1,99 @@
+//go:build tracing
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer Creates our spans. Until setupTracing sets the tracer provider its spans are no-ops that only carry the
+// trace context along.
+var tracer = otel.Tracer(serverName)
+
+// propagator Reads and writes the W3C traceparent header of the requests.
+var propagator = propagation.TraceContext{}
+
+// setupTracing Starts exporting spans over OTLP when an endpoint is set in OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, the exporter reads the rest of its OTEL_EXPORTER_OTLP settings itself. Without an
+// endpoint the spans stay no-ops. The returned function flushes the spans that haven't been exported yet.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	service, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", serverName),
+		attribute.String("service.version", version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(service))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// spanMiddleware Starts a server span for every request, as the child of the span in its traceparent header. The trace
+// id of the span replaces the one set by traceMiddleware so the logs and the exported spans agree.
+func spanMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		ctx := propagator.Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		ctx, span := tracer.Start(ctx, request.Method+" "+routeTemplate(request),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", request.Method),
+				attribute.String("url.path", request.URL.Path),
+			),
+		)
+		defer span.End()
+		if spanContext := span.SpanContext(); spanContext.IsValid() {
+			ctx = WithTraceID(ctx, spanContext.TraceID().String())
+		}
+
+		recorder := &responseWriter{ResponseWriter: response}
+		next.ServeHTTP(recorder, request.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.Status()))
+		if recorder.Status() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.Status()))
+		}
+	})
+}
+
+// startSpan Starts a span as the child of the span in the context. The returned function ends it, recording the error
+// when there is one.
+func startSpan(ctx context.Context, name string) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, name)
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// injectSpan Sets the traceparent header of an outbound request from the span in the context, so the span of the next
+// hop is its child. False is returned when the context holds no span.
+func injectSpan(ctx context.Context, request *http.Request) bool {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return false
+	}
+	propagator.Inject(ctx, propagation.HeaderCarrier(request.Header))
+	return true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJobLogsTheRequestIDOfItsRequest(t *testing.T) {
+	s, logs := newTestServer(t, nil, nil)
+	s.startWorkers(1)
+
+	ctx, cancel := context.WithCancel(WithRequestID(context.Background(), "abc"))
+	finished := make(chan error, 1)
+	err := s.enqueue(ctx, "audit", func(jobCtx context.Context) error {
+		finished <- jobCtx.Err()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the request has responded by the time the job runs, the job carries on regardless
+	cancel()
+
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Errorf("the job's context is done: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the job never ran")
+	}
+	s.stopWorkers()
+	s.background.Wait()
+
+	for _, message := range []string{"Running the audit job", "Finished the audit job"} {
+		records := logs.withMessage(t, message)
+		if len(records) != 1 || records[0]["request_id"] != "abc" {
+			t.Errorf("%q records = %v, want one with the request id abc", message, records)
+		}
+	}
+}
+
+func TestJobsStopOnShutdown(t *testing.T) {
+	s, logs := newTestServer(t, nil, nil)
+	s.startWorkers(1)
+
+	ctx := WithRequestID(context.Background(), "abc")
+	started := make(chan struct{})
+	err := s.enqueue(ctx, "slow", func(jobCtx context.Context) error {
+		close(started)
+		<-jobCtx.Done()
+		return jobCtx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	s.stopWorkers()
+	stopped := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the workers are still running after being stopped")
+	}
+
+	records := logs.withMessage(t, "Error running the slow job")
+	if len(records) != 1 || records[0]["error"] != context.Canceled.Error() || records[0]["request_id"] != "abc" {
+		t.Errorf("records = %v, want the job cancelled with the request id abc", records)
+	}
+	// nothing is left to run a job queued once the workers have stopped
+	err = s.enqueue(ctx, "late", func(context.Context) error { return nil })
+	if !errors.Is(err, errWorkersStopped) {
+		t.Errorf("error = %v, want %v", err, errWorkersStopped)
+	}
+}